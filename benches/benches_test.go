@@ -190,6 +190,16 @@ func TestHitrate(t *testing.T) {
 			return binary.BigEndian.Uint64(entry.Key()) > entries
 		}), entries)
 	})
+	t.Run("DirectCache(TinyLFU)", func(t *testing.T) { testHitrate(t, newDirectCacheWithAdmission(entries), entries) })
+	t.Run("DirectCache(S3-FIFO)", func(t *testing.T) {
+		testHitrate(t, newDirectCacheWithBuiltinPolicy(directcache.PolicyS3FIFO), entries)
+	})
+	t.Run("DirectCache(CLOCK-Pro)", func(t *testing.T) {
+		testHitrate(t, newDirectCacheWithBuiltinPolicy(directcache.PolicyClockPro), entries)
+	})
+	t.Run("DirectCache(GDSF)", func(t *testing.T) {
+		testHitrate(t, newDirectCacheWithBuiltinPolicy(directcache.PolicyGDSF), entries)
+	})
 	t.Run("FreeCache", func(t *testing.T) { testHitrate(t, newFreeCache(), entries) })
 	t.Run("FastCache", func(t *testing.T) { testHitrate(t, newFastCache(), entries) })
 	t.Run("BigCache", func(t *testing.T) { testHitrate(t, newBigCache(), entries) })
@@ -59,6 +59,38 @@ func newDirectCacheWithPolicy(shouldEvict func(entry directcache.Entry) bool) ca
 	}
 }
 
+func newDirectCacheWithAdmission(entries int) cache {
+	c := directcache.New(capacity)
+	c.SetAdmission(entries)
+	return &struct {
+		getFunc
+		setFunc
+		capacityFunc
+		closeFunc
+	}{
+		func(key []byte) ([]byte, bool) { return c.Get(key) },
+		func(key, val []byte) { c.Set(key, val) },
+		func() int { return c.Capacity() },
+		func() {},
+	}
+}
+
+func newDirectCacheWithBuiltinPolicy(policy directcache.Policy) cache {
+	c := directcache.New(capacity)
+	c.SetPolicy(policy)
+	return &struct {
+		getFunc
+		setFunc
+		capacityFunc
+		closeFunc
+	}{
+		func(key []byte) ([]byte, bool) { return c.Get(key) },
+		func(key, val []byte) { c.Set(key, val) },
+		func() int { return c.Capacity() },
+		func() {},
+	}
+}
+
 func newFreeCache() cache {
 	t := uint32(0)
 	c := freecache.NewCacheCustomTimer(capacity, nowFunc(func() uint32 {
@@ -3,17 +3,40 @@ package directcache
 import (
 	"bytes"
 	"errors"
-	"sync"
-
-	"github.com/cespare/xxhash/v2"
+	"math/rand"
+	"sync/atomic"
 )
 
 // bucket indexes and holds entries.
 type bucket struct {
-	m           vmap                   // maps key hash to offset
-	q           fifo                   // the queue buffer stores entries
-	shouldEvict func(entry Entry) bool // the custom evention policy
-	lock        sync.RWMutex
+	m           vmap                                        // maps key hash to offset
+	q           fifo                                        // the queue buffer stores entries
+	marks       marks                                       // entry offsets to locate entries at random positions
+	index       int                                         // index of the bucket in cache
+	shouldEvict func(entry Entry, ctx EvictionContext) bool // the custom evention policy
+	pushLimit   int                                         // max pushes for an insertion, 0 for default and negative for none
+	policy      Policy                                      // the built-in eviction policy
+	ghost       ghost                                       // recently evicted keys for the built-in policy
+	hot         int                                         // bytes of hot entries
+	coldTarget  int                                         // target bytes of cold entries for CLOCK-Pro
+	avgPriority float64                                     // running average priority of entries for GDSF
+	pins        map[uint64]int                              // pin counts of pinned entries
+	pinned      int                                         // bytes of pinned entries
+	pinLimit    int                                         // max bytes of pinned entries, 0 for default
+	missing     int                                         // bytes of negative entries
+	missLimit   int                                         // max bytes of negative entries, 0 for default
+	admission   *sketch                                     // the optional TinyLFU admission filter
+	ns          namespaces                                  // per-namespace quota and usage
+	count       int                                         // count of entries
+	used        int                                         // bytes of entries
+	dead        int                                         // bytes of deleted entries still in the queue
+	seq         uint64                                      // sequence of the last write
+	delSeq      uint64                                      // sequence of the last delete that DumpSince can't track
+	hashTags    bool                                        // whether hash tags are used to hash keys
+	watchers    map[uint64][]*watcher                       // watchers by key hash
+	dropped     int                                         // count of events dropped for slow watchers
+	contended   uint64                                      // count of Try* calls failed to acquire the lock, accessed atomically
+	lock        rwMutex
 }
 
 // Reset resets the bucket with new capacity and new eviction method.
@@ -21,53 +44,355 @@ type bucket struct {
 // It drops all entries.
 func (b *bucket) Reset(capacity int) {
 	b.lock.Lock()
+	b.reset(capacity)
+	b.lock.Unlock()
+}
+
+// reset is the lock-free version of Reset.
+func (b *bucket) reset(capacity int) {
+	if b.count > 0 {
+		b.tombstone()
+		b.notifyAll(EventDelete)
+	}
 	b.m.Reset(capacity - 1)
 	b.q.Reset(capacity)
-	b.lock.Unlock()
+	b.marks.Reset(capacity)
+	b.ns.Clear()
+	b.count, b.used, b.dead = 0, 0, 0
+	b.pins, b.pinned = nil, 0
+	b.missing = 0
+	b.resetPolicy()
 }
 
 // SetEvictionPolicy customizes the cache eviction policy.
-func (b *bucket) SetEvictionPolicy(shouldEvict func(entry Entry) bool) {
+func (b *bucket) SetEvictionPolicy(shouldEvict func(entry Entry, ctx EvictionContext) bool) {
 	b.lock.Lock()
 	b.shouldEvict = shouldEvict
 	b.lock.Unlock()
 }
 
+// SetPolicy sets the built-in eviction policy, which takes effect without the custom one.
+func (b *bucket) SetPolicy(policy Policy) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.policy = policy
+	b.resetPolicy()
+}
+
+// resetPolicy resets states of the built-in policy.
+func (b *bucket) resetPolicy() {
+	if b.policy == PolicyS3FIFO || b.policy == PolicyClockPro {
+		b.ghost.Reset(b.count * 2)
+	} else {
+		b.ghost = ghost{}
+	}
+	b.hot = 0
+	b.each(func(ent entry) bool {
+		if ent.HasFlag(hotFlag) {
+			b.hot += ent.Size()
+		}
+		return true
+	})
+	b.coldTarget = b.q.Cap() / 2
+	b.avgPriority = 0
+}
+
+// SetPushLimit sets the max count of entries pushed back for an insertion.
+// Negative n restores the default limit.
+func (b *bucket) SetPushLimit(n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch {
+	case n < 0:
+		b.pushLimit = 0
+	case n == 0:
+		b.pushLimit = -1
+	default:
+		b.pushLimit = n
+	}
+}
+
+// SetAdmission enables the admission filter for about n entries.
+// The filter is disabled if n is not positive.
+func (b *bucket) SetAdmission(n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if n > 0 {
+		b.admission = newSketch(n)
+	} else {
+		b.admission = nil
+	}
+}
+
+// SetNamespaces sets the key classifier and per-namespace quotas in bytes.
+// The usage of namespaces is recounted from existing entries.
+func (b *bucket) SetNamespaces(classify func(key []byte) int, quotas []int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.ns.Reset(classify, quotas)
+	b.each(func(ent entry) bool {
+		b.ns.Add(ent.Key(), ent.Size())
+		return true
+	})
+}
+
+// NamespaceUsage returns bytes of entries in the namespace.
+func (b *bucket) NamespaceUsage(ns int) int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.ns.Usage(ns)
+}
+
+// Stats returns statistics of entries.
+func (b *bucket) Stats() Stats {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return Stats{
+		Len:           b.count,
+		UsedBytes:     b.used,
+		DeadBytes:     b.dead,
+		PinnedBytes:   b.pinned,
+		MissingBytes:  b.missing,
+		DroppedEvents: b.dropped,
+		Contended:     int(atomic.LoadUint64(&b.contended)),
+	}
+}
+
 // Set set val for key.
-// false returned and nothing changed if the new entry size exceeds the capacity of this bucket.
+// false returned if the new entry size exceeds the capacity of this bucket, or the new key
+// is rejected by the admission filter. The old entry of the key is removed if failed to
+// replace it with a larger one.
 func (b *bucket) Set(key []byte, keyHash uint64, valLen int, fn func(val []byte)) bool {
+	return b.SetExt(key, keyHash, valLen, nil, fn)
+}
+
+// SetExt is like Set, with optional header fields x.
+func (b *bucket) SetExt(key []byte, keyHash uint64, valLen int, x *ext, fn func(val []byte)) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.set([][]byte{key}, keyHash, valLen, x, b.admit(keyHash), fn)
+}
+
+// CompareAndSet sets val for key with optional header fields x, only if the key exists and its version matches.
+func (b *bucket) CompareAndSet(key []byte, keyHash uint64, version uint64, valLen int, x *ext, fn func(val []byte)) bool {
 	b.lock.Lock()
 	defer b.lock.Unlock()
+	if ent, found := b.lookup(key, keyHash); !found || b.seqOf(ent) != version {
+		return false
+	}
+	return b.set([][]byte{key}, keyHash, valLen, x, b.admit(keyHash), fn)
+}
+
+// SetIf sets val for key only if the presence of the key matches present.
+func (b *bucket) SetIf(key []byte, keyHash uint64, present bool, valLen int, fn func(val []byte)) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ent, found := b.lookup(key, keyHash); (found && ent.readable()) != present {
+		return false
+	}
+	return b.set([][]byte{key}, keyHash, valLen, nil, b.admit(keyHash), fn)
+}
 
+// admit records the write to the key in the admission filter, and returns the estimated
+// frequency of the key, or -1 if no admission filter.
+func (b *bucket) admit(keyHash uint64) int {
+	if b.admission == nil {
+		return -1
+	}
+	b.admission.Age()
+	b.admission.Add(keyHash)
+	return b.admission.Estimate(keyHash)
+}
+
+// set is the lock-free version of SetExt, with the key given in parts.
+// freq is for admission, see insertEntry.
+func (b *bucket) set(keyParts [][]byte, keyHash uint64, valLen int, x *ext, freq int, fn func(val []byte)) bool {
+	extFlags := x.Flags()
+	keyLen := partsLen(keyParts)
+	if extFlags&missingExt != 0 && !b.missingFits(keyParts, keyHash, entrySizeExt(keyLen, valLen, 0, extFlags)) {
+		return false
+	}
+
+	hot, pinned := false, false
+	var old entry // the old entry of the same key
 	if offset, found := b.m.Get(keyHash); found {
 		ent := b.entryAt(offset)
-		if spare := ent.BodySize() - len(key) - valLen; spare >= 0 { // in-place update
-			fn(ent.Init(key, valLen, spare))
-			ent.AddFlag(recentlyUsedFlag) // avoid evicted too early
-			return true
+		if partsEqual(keyParts, ent.Key()) {
+			if spare := ent.BodySize() - keyLen - valLen; spare >= 0 && ent.extFlags() == extFlags { // in-place update
+				b.ns.Add(ent.Key(), -ent.Size())
+				val := ent.ReinitV(keyParts, valLen, spare, x)
+				b.stamp(ent)
+				fn(val)
+				b.ns.Add(ent.Key(), ent.Size())
+				ent.AddFlag(recentlyUsedFlag) // avoid evicted too early
+				b.notify(EventUpdate, ent.Key(), keyHash)
+				return true
+			}
+			// in-place update failed
+			pinned = ent.HasFlag(pinnedFlag)
+			if pinned && !b.repinFits(ent, entrySizeExt(keyLen, valLen, 0, extFlags)) {
+				return false
+			}
+			freq = -1 // existing key is always admitted
+			hot = ent.HasFlag(hotFlag)
+			old = ent
+		} else {
+			b.displace(ent)
 		}
-		// key not matched or in-place update failed
-		ent.AddFlag(deletedFlag)
+		b.markDeleted(ent)
+	}
+	if !hot {
+		hot = b.admitHot(keyHash, entrySizeExt(keyLen, valLen, 0, extFlags))
 	}
 	// insert new entry
-	if offset, ok := b.insertEntry(key, valLen, 0, fn); ok {
+	if offset, ok := b.insertEntry(keyParts, valLen, 0, x, freq, fn); ok {
 		b.m.Set(keyHash, offset)
+		ent := b.entryAt(offset)
+		b.added(ent)
+		if hot {
+			b.promote(ent)
+		}
+		if pinned {
+			b.pin(ent)
+		}
+		if old != nil {
+			b.notify(EventUpdate, ent.Key(), keyHash)
+		} else {
+			b.notify(EventSet, ent.Key(), keyHash)
+		}
 		return true
 	}
+	// the old entry if any was deleted
+	b.m.Del(keyHash)
+	if old != nil {
+		if pinned {
+			delete(b.pins, keyHash)
+		}
+		// it's intact since the existing key is always admitted, and insertEntry
+		// fails before evicting anything then.
+		b.notify(EventEvicted, old.Key(), keyHash)
+	}
 	return false
 }
 
+// SetE is like Set, but fn can fail. The old entry of the key is kept until fn succeeds,
+// and the new entry is discarded if fn returns an error or panics.
+// false is returned with nil error if the new entry can't be inserted, with the old entry kept.
+func (b *bucket) SetE(key []byte, keyHash uint64, valLen int, fn func(val []byte) error) (bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	keyParts := [][]byte{key}
+	freq := b.admit(keyHash)
+
+	// pin the old entry temporarily, so that it's not evicted while inserting.
+	// the temporary pin may exceed the pin limit, and the insertion fails if no space left.
+	tempPinned := false
+	if offset, found := b.m.Get(keyHash); found {
+		old := b.entryAt(offset)
+		if partsEqual(keyParts, old.Key()) {
+			if old.HasFlag(pinnedFlag) && !b.repinFits(old, entrySize(len(key), valLen, 0)) {
+				return false, nil
+			}
+			freq = -1 // existing key is always admitted
+		}
+		if !old.HasFlag(pinnedFlag) {
+			b.pin(old)
+			tempPinned = true
+		}
+	}
+	offset, ok := b.insertEntry(keyParts, valLen, 0, nil, freq, func([]byte) {})
+	var old entry // the old entry may be moved while inserting
+	if oldOffset, found := b.m.Get(keyHash); found {
+		old = b.entryAt(oldOffset)
+		if tempPinned {
+			old.RemoveFlag(pinnedFlag)
+			b.pinned -= old.Size()
+		}
+	}
+	if !ok {
+		return false, nil
+	}
+
+	ent := b.entryAt(offset)
+	committed := false
+	defer func() {
+		// discard the new entry which is not indexed yet
+		if !committed {
+			ent.AddFlag(deletedFlag)
+			b.dead += ent.Size()
+		}
+	}()
+	if err := fn(ent.Value()); err != nil {
+		return false, err
+	}
+	committed = true
+
+	hot, pinned, existed := false, false, false
+	if old != nil {
+		if bytes.Equal(old.Key(), key) {
+			hot = old.HasFlag(hotFlag)
+			pinned = old.HasFlag(pinnedFlag)
+			existed = true
+		} else {
+			b.displace(old)
+		}
+		b.markDeleted(old)
+	}
+	if !hot {
+		hot = b.admitHot(keyHash, ent.Size())
+	}
+	b.m.Set(keyHash, offset)
+	b.added(ent)
+	if hot {
+		b.promote(ent)
+	}
+	if pinned {
+		b.pin(ent)
+	}
+	if existed {
+		b.notify(EventUpdate, key, keyHash)
+	} else {
+		b.notify(EventSet, key, keyHash)
+	}
+	return true, nil
+}
+
 // Del deletes the key.
 // false is returned if key does not exist.
 func (b *bucket) Del(key []byte, keyHash uint64) bool {
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	if offset, found := b.m.Get(keyHash); found {
-		if ent := b.entryAt(offset); bytes.Equal(ent.Key(), key) {
-			b.m.Del(keyHash)
-			ent.AddFlag(deletedFlag)
-			return true
+	if ent, found := b.lookup(key, keyHash); found {
+		b.del(ent, keyHash)
+		return true
+	}
+	return false
+}
+
+// Take gets the value for key and deletes it.
+// false is returned if the key not found.
+func (b *bucket) Take(key []byte, keyHash uint64, fn func(val []byte)) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ent, found := b.lookup(key, keyHash); found && ent.readable() {
+		if fn != nil {
+			fn(ent.Value())
 		}
+		b.del(ent, keyHash)
+		return true
+	}
+	return false
+}
+
+// CompareAndDelete deletes the key only if its version matches.
+// false is returned if key does not exist or version mismatched.
+func (b *bucket) CompareAndDelete(key []byte, keyHash uint64, version uint64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ent, found := b.lookup(key, keyHash); found && b.seqOf(ent) == version {
+		b.del(ent, keyHash)
+		return true
 	}
 	return false
 }
@@ -78,10 +403,37 @@ func (b *bucket) Del(key []byte, keyHash uint64) bool {
 func (b *bucket) Get(key []byte, keyHash uint64, fn func(val []byte), peek bool) bool {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
+	return b.get(key, keyHash, fn, peek)
+}
+
+// GetExt is like Get, but fn accesses the entry.
+func (b *bucket) GetExt(key []byte, keyHash uint64, fn func(ent entry), peek bool) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if !peek && b.admission != nil {
+		b.admission.Add(keyHash)
+	}
+	if ent, found := b.lookup(key, keyHash); found && !ent.Expired() {
+		if !peek {
+			ent.AddFlag(recentlyUsedFlag)
+			ent.IncFrequency()
+		}
+		fn(ent)
+		return true
+	}
+	return false
+}
+
+// get is the lock-free version of Get.
+func (b *bucket) get(key []byte, keyHash uint64, fn func(val []byte), peek bool) bool {
+	if !peek && b.admission != nil {
+		b.admission.Add(keyHash)
+	}
 	if offset, found := b.m.Get(keyHash); found {
-		if ent := b.entryAt(offset); bytes.Equal(ent.Key(), key) {
+		if ent := b.entryAt(offset); bytes.Equal(ent.Key(), key) && ent.readable() {
 			if !peek {
 				ent.AddFlag(recentlyUsedFlag)
+				ent.IncFrequency()
 			}
 			if fn != nil {
 				fn(ent.Value())
@@ -92,11 +444,174 @@ func (b *bucket) Get(key []byte, keyHash uint64, fn func(val []byte), peek bool)
 	return false
 }
 
+// GetWithVersion is like Get, and also returns the version of the entry,
+// which is the sequence number of the last write to it.
+func (b *bucket) GetWithVersion(key []byte, keyHash uint64, fn func(val []byte), peek bool) (uint64, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if !peek && b.admission != nil {
+		b.admission.Add(keyHash)
+	}
+	if ent, found := b.lookup(key, keyHash); found && ent.readable() {
+		if !peek {
+			ent.AddFlag(recentlyUsedFlag)
+			ent.IncFrequency()
+		}
+		if fn != nil {
+			fn(ent.Value())
+		}
+		return b.seqOf(ent), true
+	}
+	return 0, false
+}
+
+// lookup returns the entry matching the key.
+func (b *bucket) lookup(key []byte, keyHash uint64) (entry, bool) {
+	if offset, found := b.m.Get(keyHash); found {
+		if ent := b.entryAt(offset); bytes.Equal(ent.Key(), key) {
+			return ent, true
+		}
+	}
+	return nil, false
+}
+
+// Compact reclaims space of deleted entries by rotating the queue, if bytes of
+// deleted entries reach deadRatio of the capacity. Live entries are kept in the
+// order of insertion. It returns bytes reclaimed.
+func (b *bucket) Compact(deadRatio float64) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	reclaimed := b.dead
+	if reclaimed == 0 || float64(reclaimed) < float64(b.q.Cap())*deadRatio {
+		return 0
+	}
+	for size := b.q.Size(); size > 0; {
+		ent := b.entryAt(b.q.Front())
+		ent = ent[:ent.Size()]
+		if _, ok := b.q.Pop(len(ent)); !ok {
+			panic(errors.New("bucket.Compact: pop entry failed"))
+		}
+		size -= len(ent)
+		if !ent.HasFlag(deletedFlag) {
+			b.pushBack(ent, hashKey(ent.Key(), b.hashTags))
+		}
+	}
+	b.dead = 0
+	return reclaimed
+}
+
 // Dump dumps entries.
 func (b *bucket) Dump(f func(Entry) bool) bool {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
+	return b.each(func(ent entry) bool { return f(ent) })
+}
+
+// DumpSince dumps entries written after the sequence since, and returns the sequence
+// of the last write. false is returned if entries are deleted after since, which
+// can't be tracked, and f is not called then.
+func (b *bucket) DumpSince(since uint64, f func(Entry) bool) (uint64, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if since > 0 && b.delSeq > since {
+		return since, false
+	}
+	if since >= b.seq {
+		return since, true
+	}
+	if !b.each(func(ent entry) bool {
+		return b.seqOf(ent) <= since || f(ent)
+	}) {
+		return since, true
+	}
+	return b.seq, true
+}
+
+// sampleTries is the max number of random positions tried per entry to sample, before Sample falls back to scanning.
+const sampleTries = 32
+
+// Sample visits k distinct entries chosen uniformly at random. All entries are visited if k is not less than the count.
+// It's interrupted if f returns false.
+//
+// Entries are located at random positions of the queue, instead of scanning the whole queue.
+func (b *bucket) Sample(k int, f func(Entry) bool) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if k <= 0 {
+		return true
+	}
+	if k >= b.count {
+		return b.each(func(ent entry) bool { return f(ent) })
+	}
+	offsets := make([]int, 0, k)
+	chosen := make(map[int]bool, k)
+	for tries := 0; len(offsets) < k; tries++ {
+		if tries == k*sampleTries {
+			// too many misses, e.g. for entries of quite different sizes
+			return b.sampleByScan(k, f)
+		}
+		if offset, ok := b.randomEntry(); ok && !chosen[offset] {
+			chosen[offset] = true
+			offsets = append(offsets, offset)
+		}
+	}
+	for _, offset := range offsets {
+		if !f(b.entryAt(offset)) {
+			return false
+		}
+	}
+	return true
+}
 
+// randomEntry returns the offset of the entry at a random position of the queue.
+// Larger entries cover more positions, so they're rejected in proportion to their sizes,
+// to give every entry the same chance. It fails for deleted and rejected entries.
+func (b *bucket) randomEntry() (int, bool) {
+	from := b.q.Front()
+	pos := from + rand.Intn(b.q.Size())
+	if n := len(b.q.Slice(0)); pos >= n {
+		// wrapped
+		from, pos = 0, pos-n
+	}
+	offset := b.marks.Before(from, pos)
+	for {
+		ent := b.entryAt(offset)
+		size := ent.Size()
+		if offset+size > pos {
+			if ent.HasFlag(deletedFlag) || rand.Intn(size) >= b.marks.minSize {
+				return 0, false
+			}
+			return offset, true
+		}
+		offset += size
+	}
+}
+
+// sampleByScan is like Sample, but scans the queue to visit chosen entries.
+func (b *bucket) sampleByScan(k int, f func(Entry) bool) bool {
+	chosen := make(map[int]bool, k)
+	for len(chosen) < k {
+		chosen[rand.Intn(b.count)] = true
+	}
+	i := 0
+	return b.each(func(ent entry) bool {
+		if chosen[i] {
+			if !f(ent) {
+				return false
+			}
+			if delete(chosen, i); len(chosen) == 0 {
+				return false
+			}
+		}
+		i++
+		return true
+	}) || len(chosen) == 0
+}
+
+// each iterates non-deleted entries in the order of insertion.
+// It's interrupted if f returns false.
+func (b *bucket) each(f func(ent entry) bool) bool {
 	size := b.q.Size()
 	offset := b.q.Front()
 	for size > 0 {
@@ -119,19 +634,46 @@ func (b *bucket) entryAt(offset int) entry {
 	return b.q.Slice(offset)
 }
 
-// insertEntry insert a new entry and returns its offset.
+// insertEntry insert a new entry with optional header fields x, and returns its offset.
 // Old entries are evicted like LRU strategy if no enough space.
-func (b *bucket) insertEntry(key []byte, valLen int, spare int, fn func(val []byte)) (int, bool) {
-	entrySize := entrySize(len(key), valLen, spare)
-	if entrySize > b.q.Cap() {
+// If freq is not negative, the new entry is rejected when its estimated frequency
+// is not greater than the victim's.
+func (b *bucket) insertEntry(keyParts [][]byte, valLen int, spare int, x *ext, freq int, fn func(val []byte)) (int, bool) {
+	extFlags := x.Flags()
+	entrySize := entrySizeExt(partsLen(keyParts), valLen, spare, extFlags)
+	// pinned entries are never evicted
+	if entrySize > b.q.Cap()-b.pinned {
 		return 0, false
 	}
+	// the namespace at quota takes space of its own entries only, which are evicted in place.
+	// entries of others are rotated until the space is reclaimed.
+	own, rotate := -1, b.q.Size()
+	if b.ns.Enabled() {
+		key := keyParts[0]
+		if len(keyParts) > 1 {
+			key = bytes.Join(keyParts, nil)
+		}
+		if !b.ns.Fits(key, entrySize) {
+			return 0, false
+		}
+		own = b.fitQuota(key, entrySize)
+	}
 
-	pushLimit := 8
+	pushLimit := b.pushLimit
+	switch {
+	case pushLimit == 0:
+		pushLimit = defaultPushLimit
+	case pushLimit < 0:
+		pushLimit = 0
+	}
 	for {
 		// have a try
 		if offset, ok := b.q.Push(nil, entrySize); ok {
-			fn(entry(b.q.Slice(offset)).Init(key, valLen, spare))
+			b.marks.Mark(offset, entrySize)
+			ent := b.entryAt(offset)
+			val := ent.InitV(keyParts, valLen, spare, x)
+			b.stamp(ent)
+			fn(val)
 			return offset, true
 		}
 
@@ -146,38 +688,165 @@ func (b *bucket) insertEntry(key []byte, valLen int, spare int, fn func(val []by
 
 		// good, deleted entry
 		if ent.HasFlag(deletedFlag) {
+			b.dead -= len(ent)
 			continue
 		}
 
-		keyHash := xxhash.Sum64(ent.Key())
-		// pushLimit exceeded
-		if pushLimit < 1 {
-			b.m.Del(keyHash)
+		keyHash := hashKey(ent.Key(), b.hashTags)
+		// always keep pinned entries. the loop ends since enough contiguous space
+		// will be available after pinned entries rotated.
+		if ent.HasFlag(pinnedFlag) {
+			b.pushBack(ent, keyHash)
+			continue
+		}
+		if own >= 0 && rotate > 0 && b.ns.of(ent.Key()) != own {
+			rotate -= len(ent)
+			b.pushBack(ent, keyHash)
 			continue
 		}
 
-		if b.shouldEvict == nil {
-			// the default LRU policy
-			if !ent.HasFlag(recentlyUsedFlag) {
-				b.m.Del(keyHash)
+		// pushLimit exceeded, or negative and expired entries which never push out real data
+		evict := pushLimit < 1 || ent.Missing() || ent.Expired()
+
+		if !evict && b.ns.Enabled() {
+			if b.ns.Over(ent.Key()) {
+				// entries of over-quota namespaces go first
+				evict = true
+			} else if b.ns.AnyOver() {
+				// keep in-quota entries as long as some namespace is over quota
+				pushLimit--
+				ent.DecFrequency()
+				b.pushBack(ent, keyHash)
 				continue
 			}
-		} else {
-			// the custom eviction policy
-			if b.shouldEvict(ent) {
-				b.m.Del(keyHash)
-				continue
+		}
+
+		if !evict {
+			if b.shouldEvict == nil {
+				// the built-in policy
+				evict = b.builtinEvict(ent)
+			} else {
+				// the custom eviction policy
+				evict = b.shouldEvict(ent, EvictionContext{
+					Bucket:      b.index,
+					BytesNeeded: entrySize,
+					BytesFree:   b.q.Cap() - b.q.Size(),
+					RetriesLeft: pushLimit,
+				})
 			}
 		}
 
+		if evict {
+			// the new entry is not admitted unless it's more frequently used than the victim
+			if freq >= 0 && b.admission.Estimate(keyHash) >= freq {
+				ent.DecFrequency()
+				b.pushBack(ent, keyHash)
+				return 0, false
+			}
+			b.forget(ent, keyHash)
+			b.evict(ent, keyHash)
+			continue
+		}
+
 		pushLimit--
 		ent.RemoveFlag(recentlyUsedFlag)
-		//  and push back to the queue
-		if offset, ok := b.q.Push(ent, 0); ok {
-			// update the offset
-			b.m.Set(keyHash, offset)
-		} else {
-			panic("bucket.allocEntry: push entry failed")
-		}
+		ent.DecFrequency()
+		b.pushBack(ent, keyHash)
+	}
+}
+
+// del deletes the entry explicitly.
+func (b *bucket) del(ent entry, keyHash uint64) {
+	b.m.Del(keyHash)
+	if ent.HasFlag(pinnedFlag) {
+		delete(b.pins, keyHash)
+	}
+	b.markDeleted(ent)
+	b.tombstone()
+	b.notify(EventDelete, ent.Key(), keyHash)
+}
+
+// tombstone records a delete, so that DumpSince signals resync.
+func (b *bucket) tombstone() {
+	b.seq++
+	b.delSeq = b.seq
+}
+
+// stamp stamps the entry being written with the current time and next sequence.
+func (b *bucket) stamp(ent entry) {
+	b.seq++
+	ent.SetStamp(now(), b.seq)
+}
+
+// seqOf returns the sequence of the write to the entry. Entries only keep the low
+// 32 bits, so it's the latest sequence matching them, which never precedes the write.
+func (b *bucket) seqOf(ent entry) uint64 {
+	return b.seq - uint64(uint32(b.seq)-uint32(ent.Seq()))
+}
+
+// added accounts the newly inserted entry.
+func (b *bucket) added(ent entry) {
+	size := ent.Size()
+	b.count++
+	b.used += size
+	b.ns.Add(ent.Key(), size)
+	if ent.Missing() {
+		b.missing += size
+	}
+}
+
+// markDeleted marks the entry deleted and accounts it as dead.
+func (b *bucket) markDeleted(ent entry) {
+	size := ent.Size()
+	b.count--
+	b.used -= size
+	b.dead += size
+	b.ns.Add(ent.Key(), -size)
+	if ent.HasFlag(hotFlag) {
+		b.hot -= size
+	}
+	if ent.HasFlag(pinnedFlag) {
+		b.pinned -= size
+	}
+	if ent.Missing() {
+		b.missing -= size
+	}
+	ent.AddFlag(deletedFlag)
+}
+
+// displace forgets the entry of another key whose index slot is taken, before it's marked deleted.
+// Index slots may only match high 32 bits of key hashes, so its key is hashed again.
+func (b *bucket) displace(ent entry) {
+	keyHash := hashKey(ent.Key(), b.hashTags)
+	if ent.HasFlag(pinnedFlag) {
+		delete(b.pins, keyHash)
+	}
+	b.tombstone()
+	b.notify(EventEvicted, ent.Key(), keyHash)
+}
+
+// evict drops the popped entry from the index.
+func (b *bucket) evict(ent entry, keyHash uint64) {
+	b.m.Del(keyHash)
+	b.count--
+	b.used -= len(ent)
+	b.ns.Add(ent.Key(), -len(ent))
+	if ent.HasFlag(hotFlag) {
+		b.hot -= len(ent)
+	}
+	if ent.Missing() {
+		b.missing -= len(ent)
+	}
+	b.notify(EventEvicted, ent.Key(), keyHash)
+}
+
+// pushBack pushes the popped entry back to the queue.
+func (b *bucket) pushBack(ent entry, keyHash uint64) {
+	if offset, ok := b.q.Push(ent, 0); ok {
+		b.marks.Mark(offset, len(ent))
+		// update the offset
+		b.m.Set(keyHash, offset)
+	} else {
+		panic("bucket.allocEntry: push entry failed")
 	}
 }
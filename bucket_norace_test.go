@@ -0,0 +1,56 @@
+//go:build !race
+// +build !race
+
+package directcache
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// Readers mark entries under the read lock by design, which the race detector reports.
+
+func Test_bucketConcurrentGet(t *testing.T) {
+	const n = 100
+	var bkt bucket
+	bkt.Reset(entrySize(2, 0, 0) * n)
+	for i := 0; i < n; i++ {
+		k := []byte{'k', byte(i)}
+		require.True(t, bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {}))
+	}
+	stats := bkt.Stats()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := 0; r < 1000; r++ {
+				for i := 0; i < n; i++ {
+					k := []byte{'k', byte(i)}
+					bkt.Get(k, xxhash.Sum64(k), nil, false)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	count := 0
+	bkt.Dump(func(e Entry) bool {
+		require.Equal(t, MaxFrequency, e.Frequency())
+		count++
+		return true
+	})
+	require.Equal(t, n, count, "no entry should look deleted")
+	require.Equal(t, stats, bkt.Stats())
+
+	// new entries evict old ones as usual
+	for i := n; i < n*2; i++ {
+		k := []byte{'k', byte(i)}
+		require.True(t, bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {}))
+	}
+	require.Equal(t, stats, bkt.Stats())
+}
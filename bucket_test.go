@@ -2,8 +2,10 @@ package directcache
 
 import (
 	"encoding/binary"
+	"errors"
 	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/stretchr/testify/require"
@@ -65,7 +67,7 @@ func Test_bucket(t *testing.T) {
 
 func Test_bucketDump(t *testing.T) {
 	var bkt bucket
-	bkt.Reset(40)
+	bkt.Reset(entrySize(2, 2, 0) * 5)
 	var ser []byte
 	// overfill, the first inserted kv should be evicted
 	for i := 0; i < 6; i++ {
@@ -99,7 +101,7 @@ func Test_bucketHitrate(t *testing.T) {
 
 	var bkt bucket
 	bkt.Reset(entrySize(len(k), 0, 0) * maxEntries)
-	bkt.SetEvictionPolicy(func(entry Entry) bool {
+	bkt.SetEvictionPolicy(func(entry Entry, _ EvictionContext) bool {
 		if entry.RecentlyUsed() {
 			return false
 		}
@@ -127,3 +129,547 @@ func Test_bucketHitrate(t *testing.T) {
 	// v0.9.1  hits: 6662 misses: 3338 hitrate: 66.62% (custom eviction policy)
 	t.Logf("hits: %d misses: %d hitrate: %.2f%%", hit, miss, hitrate*100)
 }
+
+func Test_bucketNamespaces(t *testing.T) {
+	const n = 10
+	var bkt bucket
+	bkt.Reset(entrySize(2, 0, 0) * n)
+	// namespace 0 for keys 'a?', 1 for 'b?'
+	bkt.SetNamespaces(func(key []byte) int { return int(key[0] - 'a') }, []int{entrySize(2, 0, 0) * 2, 0})
+
+	// fill with 'b?' entries
+	for i := 0; i < n; i++ {
+		k := []byte{'b', byte(i)}
+		bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {})
+	}
+	require.Equal(t, entrySize(2, 0, 0)*n, bkt.NamespaceUsage(1))
+
+	// 'a?' entries never exceed quota of namespace 0 and evict themselves
+	for i := 0; i < n; i++ {
+		k := []byte{'a', byte(i)}
+		bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {})
+	}
+	require.Equal(t, entrySize(2, 0, 0)*2, bkt.NamespaceUsage(0))
+	require.Equal(t, entrySize(2, 0, 0)*(n-2), bkt.NamespaceUsage(1))
+	k := []byte{'a', 0}
+	require.False(t, bkt.Set(k, xxhash.Sum64(k), entrySize(2, 0, 0)+1, func(val []byte) {}), "larger than the quota")
+
+	k = []byte{'a', n - 1}
+	require.True(t, bkt.Del(k, xxhash.Sum64(k)))
+	require.Equal(t, entrySize(2, 0, 0), bkt.NamespaceUsage(0))
+
+	// recount on reset of namespaces
+	bkt.SetNamespaces(func(key []byte) int { return 0 }, []int{0})
+	require.Equal(t, entrySize(2, 0, 0)*(n-1), bkt.NamespaceUsage(0))
+}
+
+func Test_bucketStats(t *testing.T) {
+	var bkt bucket
+	bkt.Reset(1000)
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		k := []byte{'k', byte(rnd.Intn(100))}
+		switch rnd.Intn(3) {
+		case 0:
+			bkt.Del(k, xxhash.Sum64(k))
+		case 1:
+			bkt.Get(k, xxhash.Sum64(k), nil, false)
+		default:
+			bkt.Set(k, xxhash.Sum64(k), rnd.Intn(20), func(val []byte) {})
+		}
+
+		count, used := 0, 0
+		bkt.Dump(func(e Entry) bool {
+			count++
+			used += e.(entry).Size()
+			return true
+		})
+		stats := bkt.Stats()
+		require.Equal(t, count, stats.Len)
+		require.Equal(t, used, stats.UsedBytes)
+		require.Equal(t, bkt.q.Size(), stats.UsedBytes+stats.DeadBytes)
+	}
+
+	bkt.Reset(1000)
+	require.Equal(t, Stats{}, bkt.Stats())
+}
+
+func Test_bucketCompact(t *testing.T) {
+	var bkt bucket
+	bkt.Reset(1000)
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		k := []byte{'k', byte(rnd.Intn(50))}
+		if rnd.Intn(3) == 0 {
+			bkt.Del(k, xxhash.Sum64(k))
+		} else {
+			bkt.Set(k, xxhash.Sum64(k), 1+rnd.Intn(20), func(val []byte) { val[0] = k[1] })
+		}
+		if i%100 != 0 {
+			continue
+		}
+
+		var before []string
+		bkt.Dump(func(e Entry) bool {
+			before = append(before, string(e.Key())+string(e.Value()))
+			return true
+		})
+		stats := bkt.Stats()
+		require.Zero(t, bkt.Compact(float64(stats.DeadBytes+1)/float64(bkt.q.Cap())), "below ratio, should not compact")
+		require.Equal(t, stats.DeadBytes, bkt.Compact(0))
+		require.Zero(t, bkt.Stats().DeadBytes)
+		require.Equal(t, stats.UsedBytes, bkt.q.Size())
+
+		var after []string
+		bkt.Dump(func(e Entry) bool {
+			after = append(after, string(e.Key())+string(e.Value()))
+			// offsets should be fixed up
+			require.True(t, bkt.Get(e.Key(), xxhash.Sum64(e.Key()), func(val []byte) {
+				require.Equal(t, e.Value(), val)
+			}, true))
+			return true
+		})
+		require.Equal(t, before, after)
+	}
+}
+
+func Test_bucketAdmission(t *testing.T) {
+	const n = 10
+	var bkt bucket
+	bkt.Reset(entrySize(2, 0, 0) * n)
+	bkt.SetAdmission(n * 100)
+
+	// hot keys
+	for i := 0; i < n; i++ {
+		k := []byte{'h', byte(i)}
+		require.True(t, bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {}))
+		bkt.Get(k, xxhash.Sum64(k), nil, false)
+		bkt.Get(k, xxhash.Sum64(k), nil, false)
+	}
+	// scan
+	for i := 0; i < n*10; i++ {
+		k := []byte{'s', byte(i)}
+		require.False(t, bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {}), "should be rejected")
+	}
+	for i := 0; i < n; i++ {
+		k := []byte{'h', byte(i)}
+		require.True(t, bkt.Get(k, xxhash.Sum64(k), nil, true), "hot key should be kept")
+	}
+	// overwriting existing key is always admitted
+	k := []byte{'h', 0}
+	bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {}) // reset the frequency of h0
+	require.True(t, bkt.Set(k, xxhash.Sum64(k), 1, func(val []byte) {}))
+
+	// frequently used new key
+	k = []byte{'n', 0}
+	for i := 0; i < 5; i++ {
+		bkt.Get(k, xxhash.Sum64(k), nil, false)
+	}
+	require.True(t, bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {}))
+
+	bkt.SetAdmission(0)
+	k = []byte{'s', 0}
+	require.True(t, bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {}), "admission disabled")
+}
+
+func Test_bucketFrequency(t *testing.T) {
+	const n = 4
+	var bkt bucket
+	bkt.Reset(entrySize(2, 0, 0) * n)
+
+	frequency := func(k []byte) (f int) {
+		bkt.Dump(func(e Entry) bool {
+			if string(e.Key()) == string(k) {
+				f = e.Frequency()
+			}
+			return true
+		})
+		return
+	}
+
+	k := []byte{'k', 0}
+	bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {})
+	require.Zero(t, frequency(k))
+	bkt.Get(k, xxhash.Sum64(k), nil, true)
+	require.Zero(t, frequency(k), "peek should not count")
+	for i := 0; i < 3; i++ {
+		bkt.Get(k, xxhash.Sum64(k), nil, false)
+	}
+	require.Equal(t, 3, frequency(k))
+	bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {})
+	require.Equal(t, 3, frequency(k), "in-place update should keep frequency")
+
+	// pushed back and decayed
+	for i := 1; i < n+1; i++ {
+		k := []byte{'k', byte(i)}
+		bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {})
+	}
+	require.Equal(t, 2, frequency(k))
+}
+
+func Test_bucketSeq(t *testing.T) {
+	var bkt bucket
+	bkt.Reset(1000)
+
+	entryOf := func(k []byte) (ent ExtEntry) {
+		bkt.Dump(func(e Entry) bool {
+			if string(e.Key()) == string(k) {
+				ent = e.(ExtEntry)
+			}
+			return true
+		})
+		return
+	}
+
+	k1, k2 := []byte("k1"), []byte("k2")
+	bkt.Set(k1, xxhash.Sum64(k1), 1, func(val []byte) {})
+	bkt.Set(k2, xxhash.Sum64(k2), 1, func(val []byte) {})
+	require.Equal(t, uint64(1), entryOf(k1).Seq())
+	require.Equal(t, uint64(2), entryOf(k2).Seq())
+	require.WithinDuration(t, time.Now(), entryOf(k1).InsertedAt(), time.Minute+time.Second)
+
+	// in-place update
+	bkt.Set(k1, xxhash.Sum64(k1), 1, func(val []byte) {})
+	require.Equal(t, uint64(3), entryOf(k1).Seq())
+	// re-insert
+	bkt.Set(k1, xxhash.Sum64(k1), 10, func(val []byte) {})
+	require.Equal(t, uint64(4), entryOf(k1).Seq())
+	require.Equal(t, entrySize(len(k1), 10, 0), entryOf(k1).Size())
+
+	// kept after reset, which also takes a sequence to record deletion
+	bkt.Reset(1000)
+	bkt.Set(k1, xxhash.Sum64(k1), 1, func(val []byte) {})
+	require.Equal(t, uint64(6), entryOf(k1).Seq())
+
+	// entries keep the low 32 bits, and full sequences are recovered across the wrap
+	bkt.seq = 1<<32 - 2
+	bkt.Set(k2, xxhash.Sum64(k2), 1, func(val []byte) {})
+	bkt.Set(k1, xxhash.Sum64(k1), 1, func(val []byte) {})
+	bkt.Set(k1, xxhash.Sum64(k1), 1, func(val []byte) {})
+	require.Equal(t, uint64(1), entryOf(k1).Seq())
+	v, _ := bkt.GetWithVersion(k1, xxhash.Sum64(k1), nil, true)
+	require.Equal(t, uint64(1<<32+1), v)
+	v, _ = bkt.GetWithVersion(k2, xxhash.Sum64(k2), nil, true)
+	require.Equal(t, uint64(1<<32-1), v)
+	var dumped []string
+	cursor, ok := bkt.DumpSince(1<<32-1, func(e Entry) bool {
+		dumped = append(dumped, string(e.Key()))
+		return true
+	})
+	require.True(t, ok)
+	require.Equal(t, uint64(1<<32+1), cursor)
+	require.Equal(t, []string{"k1"}, dumped)
+}
+
+func Test_bucketEvictionContext(t *testing.T) {
+	const n = 10
+	var bkt bucket
+	bkt.index = 3
+	bkt.Reset(entrySize(2, 0, 0) * n)
+
+	var ctxs []EvictionContext
+	bkt.SetEvictionPolicy(func(entry Entry, ctx EvictionContext) bool {
+		ctxs = append(ctxs, ctx)
+		return false
+	})
+	for i := 0; i < n+1; i++ {
+		k := []byte{'k', byte(i)}
+		bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {})
+	}
+	require.Len(t, ctxs, defaultPushLimit)
+	for i, ctx := range ctxs {
+		require.Equal(t, EvictionContext{
+			Bucket:      3,
+			BytesNeeded: entrySize(2, 0, 0),
+			BytesFree:   entrySize(2, 0, 0),
+			RetriesLeft: defaultPushLimit - i,
+		}, ctx)
+	}
+
+	// push limit
+	bkt.SetPushLimit(2)
+	ctxs = nil
+	k := []byte{'k', n + 1}
+	bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {})
+	require.Len(t, ctxs, 2)
+
+	bkt.SetPushLimit(0)
+	ctxs = nil
+	k = []byte{'k', n + 2}
+	bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {})
+	require.Empty(t, ctxs)
+
+	bkt.SetPushLimit(-1)
+	ctxs = nil
+	k = []byte{'k', n + 3}
+	bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {})
+	require.Len(t, ctxs, defaultPushLimit)
+}
+
+func Test_bucketCompareAndSet(t *testing.T) {
+	var bkt bucket
+	bkt.Reset(1000)
+
+	k := []byte("k")
+	kh := xxhash.Sum64(k)
+	require.False(t, bkt.CompareAndSet(k, kh, 0, 1, nil, func(val []byte) {}), "missing key")
+
+	bkt.Set(k, kh, 1, func(val []byte) {})
+	v1, ok := bkt.GetWithVersion(k, kh, nil, true)
+	require.True(t, ok)
+
+	// in-place update bumps the version
+	require.True(t, bkt.CompareAndSet(k, kh, v1, 1, nil, func(val []byte) { val[0] = 'a' }))
+	require.False(t, bkt.CompareAndSet(k, kh, v1, 1, nil, func(val []byte) { val[0] = 'b' }), "stale version")
+	v2, _ := bkt.GetWithVersion(k, kh, func(val []byte) { require.Equal(t, []byte("a"), val) }, true)
+	require.Greater(t, v2, v1)
+
+	// re-insert bumps the version
+	require.True(t, bkt.CompareAndSet(k, kh, v2, 10, nil, func(val []byte) {}))
+	v3, _ := bkt.GetWithVersion(k, kh, nil, true)
+	require.Greater(t, v3, v2)
+
+	require.False(t, bkt.CompareAndDelete(k, kh, v2))
+	require.True(t, bkt.CompareAndDelete(k, kh, v3))
+	_, ok = bkt.GetWithVersion(k, kh, nil, true)
+	require.False(t, ok)
+
+	// versions never repeat even after reset
+	bkt.Reset(1000)
+	bkt.Set(k, kh, 1, func(val []byte) {})
+	v4, _ := bkt.GetWithVersion(k, kh, nil, true)
+	require.Greater(t, v4, v3)
+}
+
+func Test_bucketDumpSince(t *testing.T) {
+	var bkt bucket
+	bkt.Reset(1000)
+
+	set := func(k string, valLen int) {
+		bkt.Set([]byte(k), xxhash.Sum64([]byte(k)), valLen, func(val []byte) {})
+	}
+	dump := func(since uint64) (keys []string, next uint64, ok bool) {
+		next, ok = bkt.DumpSince(since, func(e Entry) bool {
+			keys = append(keys, string(e.Key()))
+			return true
+		})
+		return
+	}
+
+	keys, cur, ok := dump(0)
+	require.True(t, ok)
+	require.Empty(t, keys)
+	require.Zero(t, cur)
+
+	set("k1", 1)
+	set("k2", 1)
+	keys, cur, ok = dump(cur)
+	require.True(t, ok)
+	require.Equal(t, []string{"k1", "k2"}, keys)
+
+	keys, cur, ok = dump(cur)
+	require.True(t, ok)
+	require.Empty(t, keys)
+
+	// in-place update and re-insert
+	set("k1", 1)
+	set("k3", 1)
+	set("k2", 10)
+	keys, cur, ok = dump(cur)
+	require.True(t, ok)
+	require.Equal(t, []string{"k1", "k3", "k2"}, keys)
+
+	// interrupted
+	set("k3", 1)
+	n, ok := bkt.DumpSince(cur, func(Entry) bool { return false })
+	require.True(t, ok)
+	require.Equal(t, cur, n)
+
+	// delete requires resync
+	bkt.Del([]byte("k1"), xxhash.Sum64([]byte("k1")))
+	_, _, ok = dump(cur)
+	require.False(t, ok)
+	keys, cur, ok = dump(0)
+	require.True(t, ok)
+	require.Equal(t, []string{"k3", "k2"}, keys)
+	_, _, ok = dump(cur)
+	require.True(t, ok)
+
+	bkt.Reset(1000)
+	_, _, ok = dump(cur)
+	require.False(t, ok)
+}
+
+func Test_bucketSample(t *testing.T) {
+	var bkt bucket
+	bkt.Reset(10000)
+
+	for i := 0; i < 100; i++ {
+		k := []byte{'k', byte(i)}
+		bkt.Set(k, xxhash.Sum64(k), 1, func(val []byte) { val[0] = byte(i) })
+	}
+	for i := 0; i < 100; i += 10 {
+		k := []byte{'k', byte(i)}
+		bkt.Del(k, xxhash.Sum64(k))
+	}
+
+	sample := func(k int) (vals []byte) {
+		bkt.Sample(k, func(e Entry) bool {
+			require.False(t, e.RecentlyUsed())
+			vals = append(vals, e.Value()[0])
+			return true
+		})
+		return
+	}
+	require.Empty(t, sample(0))
+	require.Len(t, sample(1000), 90)
+
+	hits := make(map[byte]int)
+	for i := 0; i < 1000; i++ {
+		vals := sample(9)
+		require.Len(t, vals, 9)
+		seen := make(map[byte]bool)
+		for _, v := range vals {
+			require.NotZero(t, v%10, "deleted entry sampled")
+			require.False(t, seen[v], "sampled twice")
+			seen[v] = true
+			hits[v]++
+		}
+	}
+	// each entry is expected to be sampled 100 times
+	for _, n := range hits {
+		require.InDelta(t, 100, n, 50)
+	}
+
+	// interrupted
+	n := 0
+	require.False(t, bkt.Sample(5, func(Entry) bool { n++; return n < 2 }))
+	require.Equal(t, 2, n)
+
+	// entries of different sizes, in a wrapped queue
+	bkt.Reset(20000)
+	for i := 0; i < 1000; i++ {
+		k := []byte{'k', byte(i), byte(i >> 8)}
+		bkt.Set(k, xxhash.Sum64(k), 1+i%30, func(val []byte) { val[0] = byte(i % 100) })
+	}
+	require.True(t, bkt.q.Back() < bkt.q.Front())
+	hits = make(map[byte]int)
+	for i := 0; i < 10000; i++ {
+		bkt.Sample(1, func(e Entry) bool {
+			hits[e.Value()[0]]++
+			return true
+		})
+	}
+	// entries are grouped by value, each group of about the same count is expected to be sampled 100 times
+	for _, n := range hits {
+		require.InDelta(t, 100, n, 50)
+	}
+}
+
+func Test_bucketConditional(t *testing.T) {
+	var bkt bucket
+	bkt.Reset(1000)
+
+	k := []byte("k")
+	kh := xxhash.Sum64(k)
+	valOf := func() (v []byte) {
+		bkt.Get(k, kh, func(val []byte) { v = append(v, val...) }, true)
+		return
+	}
+
+	require.False(t, bkt.SetIf(k, kh, true, 1, func(val []byte) { val[0] = 'a' }), "replace missing key")
+	require.True(t, bkt.SetIf(k, kh, false, 1, func(val []byte) { val[0] = 'b' }))
+	require.False(t, bkt.SetIf(k, kh, false, 1, func(val []byte) { val[0] = 'c' }), "add existing key")
+	require.Equal(t, []byte("b"), valOf())
+	require.True(t, bkt.SetIf(k, kh, true, 2, func(val []byte) { copy(val, "dd") }))
+	require.Equal(t, []byte("dd"), valOf())
+
+	var taken []byte
+	require.True(t, bkt.Take(k, kh, func(val []byte) { taken = append(taken, val...) }))
+	require.Equal(t, []byte("dd"), taken)
+	require.False(t, bkt.Take(k, kh, nil))
+	require.Zero(t, bkt.Stats().Len)
+}
+
+func Test_bucketSetE(t *testing.T) {
+	var bkt bucket
+	size := entrySize(2, 10, 0)
+	bkt.Reset(size * 4)
+
+	set := func(k string) {
+		bkt.Set([]byte(k), xxhash.Sum64([]byte(k)), 10, func(val []byte) { copy(val, k) })
+	}
+	valOf := func(k string) (v []byte) {
+		bkt.Get([]byte(k), xxhash.Sum64([]byte(k)), func(val []byte) { v = append(v, val...) }, true)
+		return
+	}
+	setE := func(k string, fn func(val []byte) error) (bool, error) {
+		return bkt.SetE([]byte(k), xxhash.Sum64([]byte(k)), 10, fn)
+	}
+
+	set("k1")
+	errDecode := errors.New("decode")
+	ok, err := setE("k1", func(val []byte) error { copy(val, "half"); return errDecode })
+	require.False(t, ok)
+	require.Equal(t, errDecode, err)
+	require.Equal(t, "k1", string(valOf("k1")[:2]))
+	require.Equal(t, 1, bkt.Stats().Len)
+	require.Equal(t, size, bkt.Stats().DeadBytes)
+
+	require.Panics(t, func() {
+		setE("k1", func(val []byte) error { panic("boom") })
+	})
+	require.Equal(t, "k1", string(valOf("k1")[:2]))
+	set("k2") // lock released
+
+	// old entry at the front is kept while others are evicted
+	bkt.Reset(size * 4)
+	for _, k := range []string{"k1", "k2", "k3", "k4"} {
+		set(k)
+	}
+	_, err = setE("k1", func(val []byte) error { return errDecode })
+	require.Equal(t, errDecode, err)
+	require.Equal(t, "k1", string(valOf("k1")[:2]))
+	require.Nil(t, valOf("k2"))
+	require.Zero(t, bkt.Stats().PinnedBytes)
+
+	ok, err = setE("k1", func(val []byte) error { copy(val, "new"); return nil })
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(valOf("k1")[:3]))
+	require.Equal(t, 2, bkt.Stats().Len, "k1 and k4")
+	require.Zero(t, bkt.Stats().PinnedBytes)
+
+	// no space for both
+	ok, err = bkt.SetE([]byte("k1"), xxhash.Sum64([]byte("k1")), size*3, func(val []byte) error {
+		panic("should not be called")
+	})
+	require.False(t, ok)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(valOf("k1")[:3]))
+}
+
+func Test_bucketMissing(t *testing.T) {
+	var bkt bucket
+	size := entrySize(2, 0, 0)
+	bkt.Reset(size * 4)
+
+	keyOf := func(i int) []byte { return []byte{'k', byte(i)} }
+	missing := &ext{flags: missingExt}
+	for i := 0; i < 2; i++ {
+		k := keyOf(i)
+		bkt.SetExt(k, xxhash.Sum64(k), 0, missing, func([]byte) {})
+		// recently used, but still evicted first
+		bkt.GetExt(k, xxhash.Sum64(k), func(ent entry) { require.True(t, ent.Missing()) }, false)
+	}
+	for i := 2; i < 6; i++ {
+		k := keyOf(i)
+		require.True(t, bkt.Set(k, xxhash.Sum64(k), 0, func([]byte) {}))
+	}
+	for i := 0; i < 6; i++ {
+		k := keyOf(i)
+		require.Equal(t, i >= 2, bkt.GetExt(k, xxhash.Sum64(k), func(entry) {}, true), i)
+	}
+}
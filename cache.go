@@ -1,7 +1,12 @@
 // Package directcache is a high performance GC-free cache library.
 package directcache
 
-import "github.com/cespare/xxhash/v2"
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
 
 const (
 	// BucketCount is the count of buckets in a Cache instance.
@@ -10,16 +15,33 @@ const (
 	MinCapacity = BucketCount * 256
 )
 
+// Stats is the statistics of cached entries.
+type Stats struct {
+	Len           int // count of entries, including negative ones set by SetMissing
+	UsedBytes     int // bytes occupied by entries
+	DeadBytes     int // bytes occupied by deleted or overwritten entries and not reclaimed yet
+	PinnedBytes   int // bytes occupied by pinned entries
+	MissingBytes  int // bytes occupied by negative entries
+	DroppedEvents int // count of watch events dropped for slow watchers
+	Contended     int // count of TryGet/TrySet calls failed for lock contention
+}
+
 // Cache caches key-value entries of type []byte.
 type Cache struct {
-	buckets [BucketCount]bucket
-	cap     int
+	buckets     [BucketCount]bucket
+	cap         int
+	hashTags    uint32 // 1 if hash tags enabled
+	refreshLock sync.Mutex
+	refreshing  map[string]bool // keys being refreshed by GetFresh
 }
 
 // New creates a new Cache instance with the given capacity in bytes.
 // The instance capacity will be set to MinCapacity at minimum.
 func New(capacity int) *Cache {
 	c := &Cache{}
+	for i := 0; i < BucketCount; i++ {
+		c.buckets[i].index = i
+	}
 	c.Reset(capacity)
 	return c
 }
@@ -27,6 +49,77 @@ func New(capacity int) *Cache {
 // Capacity returns the cache capacity.
 func (c *Cache) Capacity() int { return c.cap }
 
+// Len returns the count of entries, including negative ones set by SetMissing.
+func (c *Cache) Len() int { return c.Stats().Len }
+
+// UsedBytes returns bytes occupied by entries.
+func (c *Cache) UsedBytes() int { return c.Stats().UsedBytes }
+
+// DeadBytes returns bytes occupied by deleted or overwritten entries which are
+// not reclaimed yet.
+func (c *Cache) DeadBytes() int { return c.Stats().DeadBytes }
+
+// Stats returns the statistics of all buckets.
+func (c *Cache) Stats() (stats Stats) {
+	for i := 0; i < BucketCount; i++ {
+		s := c.buckets[i].Stats()
+		stats.Len += s.Len
+		stats.UsedBytes += s.UsedBytes
+		stats.DeadBytes += s.DeadBytes
+		stats.PinnedBytes += s.PinnedBytes
+		stats.MissingBytes += s.MissingBytes
+		stats.DroppedEvents += s.DroppedEvents
+		stats.Contended += s.Contended
+	}
+	return
+}
+
+// BucketStats returns the statistics of the i-th bucket.
+func (c *Cache) BucketStats(i int) Stats {
+	return c.buckets[i].Stats()
+}
+
+// Compact reclaims space occupied by deleted or overwritten entries, and returns
+// bytes reclaimed. Buckets are compacted one by one, so that other buckets are
+// accessible meanwhile.
+func (c *Cache) Compact() int {
+	reclaimed := 0
+	for i := 0; i < BucketCount; i++ {
+		reclaimed += c.buckets[i].Compact(0)
+	}
+	return reclaimed
+}
+
+// StartCompactor starts a background goroutine, which checks buckets every interval
+// and compacts those with dead bytes exceed deadRatio of the bucket capacity.
+// The returned stop func stops the goroutine.
+func (c *Cache) StartCompactor(interval time.Duration, deadRatio float64) (stop func()) {
+	var (
+		done = make(chan struct{})
+		once sync.Once
+	)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			for i := 0; i < BucketCount; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				c.buckets[i].Compact(deadRatio)
+			}
+		}
+	}()
+	return func() { once.Do(func() { close(done) }) }
+}
+
 // Reset resets the cache with new capacity and drops all cached entries.
 func (c *Cache) Reset(capacity int) {
 	if capacity < MinCapacity {
@@ -44,28 +137,265 @@ func (c *Cache) Reset(capacity int) {
 // If shouldEvict returns true the old entry will evict immediately, and if false the old entry
 // will likely be kept. The provided entry is read-only and never modify its key or value.
 func (c *Cache) SetEvictionPolicy(shouldEvict func(entry Entry) bool) {
+	if shouldEvict == nil {
+		c.SetContextEvictionPolicy(nil)
+		return
+	}
+	c.SetContextEvictionPolicy(func(entry Entry, _ EvictionContext) bool {
+		return shouldEvict(entry)
+	})
+}
+
+// SetContextEvictionPolicy is like SetEvictionPolicy, but shouldEvict is also provided
+// with the context of the bucket, e.g. how much space is needed and how many entries
+// can still be kept. A nil shouldEvict restores the default LRU policy.
+func (c *Cache) SetContextEvictionPolicy(shouldEvict func(entry Entry, ctx EvictionContext) bool) {
 	for i := 0; i < BucketCount; i++ {
 		c.buckets[i].SetEvictionPolicy(shouldEvict)
 	}
 }
 
+// SetPolicy selects the built-in eviction policy, which is PolicyLRU by default.
+// The custom eviction policy, if set, takes precedence over the built-in one.
+func (c *Cache) SetPolicy(policy Policy) {
+	for i := 0; i < BucketCount; i++ {
+		c.buckets[i].SetPolicy(policy)
+	}
+}
+
+// SetPushLimit sets the max count of entries kept by the eviction policy, i.e. pushed
+// back to the queue, while inserting an entry. Entries beyond the limit are evicted
+// regardless of the policy. The default limit is 8, and 0 means always evicting.
+// A negative n restores the default limit.
+func (c *Cache) SetPushLimit(n int) {
+	for i := 0; i < BucketCount; i++ {
+		c.buckets[i].SetPushLimit(n)
+	}
+}
+
+// SetAdmission enables the TinyLFU admission filter, which is designed for about
+// the given count of entries. A non-positive entries disables the filter.
+//
+// Access frequencies of keys are estimated by count-min sketches, and halved periodically.
+// When no space to insert the entry of a new key, it's rejected unless its estimated
+// frequency is greater than that of the entry to be evicted. So that scan-like traffic
+// will not flush frequently used entries.
+func (c *Cache) SetAdmission(entries int) {
+	bktEntries := 0
+	if entries > 0 {
+		bktEntries = entries/BucketCount + 1
+	}
+	for i := 0; i < BucketCount; i++ {
+		c.buckets[i].SetAdmission(bktEntries)
+	}
+}
+
+// SetNamespaces partitions entries into namespaces, each with a quota in bytes.
+// classify maps a key to the index of its namespace in quotas, and keys mapped out of
+// range are not accounted. A non-positive quota means no limit.
+// Quotas are evenly split among buckets. A nil classify disables namespaces.
+//
+// A new entry of the namespace at quota evicts the oldest entries of the same namespace,
+// instead of others, and Set fails if it's larger than the quota. Pinned entries are never
+// evicted for quotas. Entries of namespaces over quota, e.g. after quotas shrink, are evicted
+// in preference to others when no space.
+//
+// classify should be fast and never modify the key.
+func (c *Cache) SetNamespaces(classify func(key []byte) int, quotas []int) {
+	bktQuotas := make([]int, len(quotas))
+	for i, q := range quotas {
+		if bktQuotas[i] = q / BucketCount; q > 0 && bktQuotas[i] == 0 {
+			bktQuotas[i] = 1
+		}
+	}
+	for i := 0; i < BucketCount; i++ {
+		c.buckets[i].SetNamespaces(classify, bktQuotas)
+	}
+}
+
+// SetNamespaceWeights is like SetNamespaces, but each namespace is given a weight instead
+// of a quota, and the quota is its share of the current capacity by weight.
+// A non-positive weight means no limit.
+func (c *Cache) SetNamespaceWeights(classify func(key []byte) int, weights []int) {
+	var sum int64
+	for _, w := range weights {
+		if w > 0 {
+			sum += int64(w)
+		}
+	}
+	quotas := make([]int, len(weights))
+	for i, w := range weights {
+		if w > 0 {
+			quotas[i] = int(int64(c.cap) * int64(w) / sum)
+		}
+	}
+	c.SetNamespaces(classify, quotas)
+}
+
+// NamespaceUsage returns the total size in bytes of entries in the namespace.
+func (c *Cache) NamespaceUsage(ns int) int {
+	usage := 0
+	for i := 0; i < BucketCount; i++ {
+		usage += c.buckets[i].NamespaceUsage(ns)
+	}
+	return usage
+}
+
 // Set stores the (key, val) entry in the cache, and returns false on failure.
-// It always succeeds unless the size of the entry exceeds 1/BucketCount of the cache capacity.
+// It always succeeds unless the size of the entry exceeds 1/BucketCount of the cache capacity
+// excluding bytes of pinned entries in the bucket, or the entry is rejected by the admission filter.
 //
 // It's safe to modify contents of key and val after Set returns.
 func (c *Cache) Set(key, val []byte) bool {
-	keyHash := xxhash.Sum64(key)
+	keyHash := c.hash(key)
 	return c.buckets[keyHash%BucketCount].Set(key, keyHash, len(val), func(_val []byte) {
 		copy(_val, val)
 	})
 }
 
+// SetWithCost is like Set, and the entry is stored with the cost to recompute it,
+// which is considered by PolicyGDSF and exposed to custom policies via ExtEntry.
+// The cost is clamped to [0, math.MaxInt32].
+func (c *Cache) SetWithCost(key, val []byte, cost int) bool {
+	if cost < 0 {
+		cost = 0
+	} else if int64(cost) > math.MaxInt32 {
+		cost = math.MaxInt32
+	}
+	keyHash := c.hash(key)
+	return c.buckets[keyHash%BucketCount].SetExt(key, keyHash, len(val), &ext{flags: costExt, cost: uint32(cost)}, func(_val []byte) {
+		copy(_val, val)
+	})
+}
+
+// Add is like Set, but only stores the entry if no entry matching the given key.
+//
+// It's safe to modify contents of key and val after Add returns.
+func (c *Cache) Add(key, val []byte) bool {
+	return c.AdvAdd(key, len(val), func(_val []byte) { copy(_val, val) })
+}
+
+// AdvAdd is the advanced version of Add. fn callback is for value assignment.
+func (c *Cache) AdvAdd(key []byte, valLen int, fn func(val []byte)) bool {
+	keyHash := c.hash(key)
+	return c.buckets[keyHash%BucketCount].SetIf(key, keyHash, false, valLen, fn)
+}
+
+// Replace is like Set, but only stores the entry if there's an entry matching the given key.
+//
+// It's safe to modify contents of key and val after Replace returns.
+func (c *Cache) Replace(key, val []byte) bool {
+	return c.AdvReplace(key, len(val), func(_val []byte) { copy(_val, val) })
+}
+
+// AdvReplace is the advanced version of Replace. fn callback is for value assignment.
+func (c *Cache) AdvReplace(key []byte, valLen int, fn func(val []byte)) bool {
+	keyHash := c.hash(key)
+	return c.buckets[keyHash%BucketCount].SetIf(key, keyHash, true, valLen, fn)
+}
+
+// SetWithMeta is like Set, and the entry is stored with the caller-defined metadata,
+// e.g. content type or schema version, which is returned by GetWithMeta, and exposed
+// via Entry.Meta to eviction policies and Dump.
+func (c *Cache) SetWithMeta(key, val []byte, meta uint32) bool {
+	keyHash := c.hash(key)
+	return c.buckets[keyHash%BucketCount].SetExt(key, keyHash, len(val), &ext{flags: metaExt, meta: meta}, func(_val []byte) {
+		copy(_val, val)
+	})
+}
+
+// SetMissing stores a negative entry for the given key, which records that the key is known
+// to be missing, e.g. not found in the database. Negative entries are invisible to Get,
+// and reported by Lookup. They're evicted without a second chance when they reach the front
+// of the queue. They're counted by Len and Stats, and visited by Dump.
+//
+// It returns false if bytes of negative entries of the bucket would exceed the limit
+// (see SetMissingLimit), so that negative entries never push out real entries beyond it.
+func (c *Cache) SetMissing(key []byte) bool {
+	keyHash := c.hash(key)
+	return c.buckets[keyHash%BucketCount].SetExt(key, keyHash, 0, &ext{flags: missingExt}, func([]byte) {})
+}
+
+// SetMissingLimit sets the max bytes of negative entries, which are evenly split among buckets.
+// A non-positive limit restores the default, which is 1/8 of the capacity.
+func (c *Cache) SetMissingLimit(limit int) {
+	bktLimit := 0
+	if limit > 0 {
+		if bktLimit = limit / BucketCount; bktLimit == 0 {
+			bktLimit = 1
+		}
+	}
+	for i := 0; i < BucketCount; i++ {
+		c.buckets[i].SetMissingLimit(bktLimit)
+	}
+}
+
+// LookupResult is the result of Lookup.
+type LookupResult int
+
+// lookup results.
+const (
+	LookupUnknown LookupResult = iota // no entry for the key
+	LookupFound                       // the key is found with the value
+	LookupMissing                     // the key is known to be missing, see SetMissing
+)
+
+// Lookup is like Get, but tells whether the key is known to be missing.
+//
+// It's safe to modify contents of key after Lookup returns.
+func (c *Cache) Lookup(key []byte) (val []byte, result LookupResult) {
+	keyHash := c.hash(key)
+	c.buckets[keyHash%BucketCount].GetExt(key, keyHash, func(ent entry) {
+		if ent.Missing() {
+			result = LookupMissing
+		} else {
+			val = append(val, ent.Value()...)
+			result = LookupFound
+		}
+	}, false)
+	return
+}
+
+// Pin pins the entry matching the given key, so that it's never evicted until unpinned
+// or deleted. Pins are counted, and the entry is unpinned after the same count of Unpin calls.
+// Overwriting the entry keeps it pinned, and fails if pinned bytes would exceed the pin limit then.
+//
+// It returns false if no matched entry, or pinned bytes of the bucket would exceed the
+// pin limit (see SetPinLimit).
+func (c *Cache) Pin(key []byte) bool {
+	keyHash := c.hash(key)
+	return c.buckets[keyHash%BucketCount].Pin(key, keyHash)
+}
+
+// Unpin decreases the pin count of the entry matching the given key.
+// It returns false if the entry is not pinned.
+func (c *Cache) Unpin(key []byte) bool {
+	keyHash := c.hash(key)
+	return c.buckets[keyHash%BucketCount].Unpin(key, keyHash)
+}
+
+// SetPinLimit sets the max bytes of pinned entries, which are evenly split among buckets.
+// A non-positive limit restores the default, which is half of the capacity.
+//
+// AdvSetE and Txn pin entries temporarily while writing, which may exceed the limit.
+func (c *Cache) SetPinLimit(limit int) {
+	bktLimit := 0
+	if limit > 0 {
+		if bktLimit = limit / BucketCount; bktLimit == 0 {
+			bktLimit = 1
+		}
+	}
+	for i := 0; i < BucketCount; i++ {
+		c.buckets[i].SetPinLimit(bktLimit)
+	}
+}
+
 // Del deletes the entry matching the given key from the cache.
 // false is returned if no entry matched.
 //
 // It's safe to modify contents of key after Del returns.
 func (c *Cache) Del(key []byte) bool {
-	keyHash := xxhash.Sum64(key)
+	keyHash := c.hash(key)
 	return c.buckets[keyHash%BucketCount].Del(key, keyHash)
 }
 
@@ -74,18 +404,85 @@ func (c *Cache) Del(key []byte) bool {
 //
 // It's safe to modify contents of key after Get returns.
 func (c *Cache) Get(key []byte) (val []byte, ok bool) {
-	keyHash := xxhash.Sum64(key)
+	keyHash := c.hash(key)
 	ok = c.buckets[keyHash%BucketCount].Get(key, keyHash, func(_val []byte) {
 		val = append(val, _val...)
 	}, false)
 	return
 }
 
+// Take returns the value of the entry matching the given key, and deletes the entry atomically.
+// It returns false if no matched entry.
+func (c *Cache) Take(key []byte) (val []byte, ok bool) {
+	ok = c.AdvTake(key, func(_val []byte) {
+		val = append(val, _val...)
+	})
+	return
+}
+
+// AdvTake is the advanced version of Take. val is (zero-copy) accessed via fn callback,
+// and only valid inside fn.
+func (c *Cache) AdvTake(key []byte, fn func(val []byte)) bool {
+	keyHash := c.hash(key)
+	return c.buckets[keyHash%BucketCount].Take(key, keyHash, fn)
+}
+
+// Touch marks the entry matching the given key recently used without reading its value.
+// It returns false if no matched entry.
+func (c *Cache) Touch(key []byte) bool {
+	keyHash := c.hash(key)
+	return c.buckets[keyHash%BucketCount].Get(key, keyHash, nil, false)
+}
+
+// GetWithMeta is like Get, and also returns the metadata set by SetWithMeta, which is 0
+// if not set.
+func (c *Cache) GetWithMeta(key []byte) (val []byte, meta uint32, ok bool) {
+	keyHash := c.hash(key)
+	c.buckets[keyHash%BucketCount].GetExt(key, keyHash, func(ent entry) {
+		if ok = !ent.Missing(); ok {
+			val = append(val, ent.Value()...)
+			meta = ent.Meta()
+		}
+	}, false)
+	return
+}
+
+// GetWithVersion is like Get, and also returns the version of the entry.
+// The version changes on every write to the entry, and never repeats for the same key
+// during the cache's lifetime. It's used by CompareAndSet and CompareAndDelete for
+// optimistic concurrency control.
+func (c *Cache) GetWithVersion(key []byte) (val []byte, version uint64, ok bool) {
+	keyHash := c.hash(key)
+	version, ok = c.buckets[keyHash%BucketCount].GetWithVersion(key, keyHash, func(_val []byte) {
+		val = append(val, _val...)
+	}, false)
+	return
+}
+
+// CompareAndSet stores the (key, val) entry only if the entry matching the given key
+// exists and its version equals to the given version. It returns false if the version
+// mismatched, or the entry cannot be stored, see Set.
+//
+// It's safe to modify contents of key and val after CompareAndSet returns.
+func (c *Cache) CompareAndSet(key []byte, version uint64, val []byte) bool {
+	keyHash := c.hash(key)
+	return c.buckets[keyHash%BucketCount].CompareAndSet(key, keyHash, version, len(val), nil, func(_val []byte) {
+		copy(_val, val)
+	})
+}
+
+// CompareAndDelete deletes the entry matching the given key only if its version equals
+// to the given version. It returns false if no matched entry or the version mismatched.
+func (c *Cache) CompareAndDelete(key []byte, version uint64) bool {
+	keyHash := c.hash(key)
+	return c.buckets[keyHash%BucketCount].CompareAndDelete(key, keyHash, version)
+}
+
 // Has returns false if no entry matching the given key.
 //
 // It's safe to modify contents of key after Has returns.
 func (c *Cache) Has(key []byte) bool {
-	keyHash := xxhash.Sum64(key)
+	keyHash := c.hash(key)
 	return c.buckets[keyHash%BucketCount].Get(key, keyHash, nil, false)
 }
 
@@ -96,22 +493,103 @@ func (c *Cache) Has(key []byte) bool {
 // val is only valid inside fn and should never be modified.
 // It's safe to modify contents of key after AdvGet returns.
 func (c *Cache) AdvGet(key []byte, fn func(val []byte), peek bool) bool {
-	keyHash := xxhash.Sum64(key)
+	keyHash := c.hash(key)
 	return c.buckets[keyHash%BucketCount].Get(key, keyHash, fn, peek)
 }
 
 // AdvSet is the advanced version of Set. fn callback is for value assignment.
-// It always succeeds unless the size of the entry exceeds 1/BucketCount of the cache capacity.
+// It always succeeds unless the size of the entry exceeds 1/BucketCount of the cache capacity
+// excluding bytes of pinned entries in the bucket, or the entry is rejected by the admission filter.
 //
 // It's safe to modify contents of key after AdvSet returns.
 func (c *Cache) AdvSet(key []byte, valLen int, fn func(val []byte)) bool {
-	keyHash := xxhash.Sum64(key)
+	keyHash := c.hash(key)
 	return c.buckets[keyHash%BucketCount].Set(key, keyHash, valLen, fn)
 }
 
+// Sample visits n live entries chosen uniformly at random, without replacement.
+// All entries are visited if n is not less than the count of entries.
+// It's interrupted if f returns false.
+// Like Dump, the provided entry is read-only, and recently-used flags are not touched.
+//
+// Entries are located at random positions of bucket queues, so it doesn't scan the whole cache
+// unless entries are of quite different sizes.
+func (c *Cache) Sample(n int, f func(Entry) bool) {
+	var (
+		counts [BucketCount]int
+		total  int
+	)
+	for i := 0; i < BucketCount; i++ {
+		counts[i] = c.buckets[i].Stats().Len
+		total += counts[i]
+	}
+	var picks [BucketCount]int
+	if n >= total {
+		picks = counts
+	} else {
+		// pick buckets one by one, weighted by counts of entries not picked
+		for picked := 0; picked < n; picked++ {
+			r, i := rand.Intn(total-picked), 0
+			for ; r >= counts[i]-picks[i]; i++ {
+				r -= counts[i] - picks[i]
+			}
+			picks[i]++
+		}
+	}
+	for i := 0; i < BucketCount; i++ {
+		if !c.buckets[i].Sample(picks[i], f) {
+			break
+		}
+	}
+}
+
+// Cursor records per-bucket write sequences for DumpSince.
+// The zero value is for a full dump.
+type Cursor [BucketCount]uint64
+
+// DumpSince is like Dump, but only dumps entries written (inserted or updated) after
+// the cursor, and returns the cursor for the next call. It's for replicating the cache
+// incrementally. If interrupted by f, the cursor is not advanced for the rest buckets.
+//
+// Evicted entries are not reported. Explicitly deleted entries are not tracked either,
+// and false is returned if any entry deleted after the cursor. The replica should
+// be cleared and fully synced with the zero cursor then.
+func (c *Cache) DumpSince(cursor Cursor, f func(Entry) bool) (next Cursor, ok bool) {
+	next = cursor
+	stop := false
+	for i := 0; i < BucketCount; i++ {
+		var seq uint64
+		if seq, ok = c.buckets[i].DumpSince(cursor[i], func(ent Entry) bool {
+			stop = !f(ent)
+			return !stop
+		}); !ok {
+			return
+		}
+		next[i] = seq
+		if stop {
+			break
+		}
+	}
+	return next, true
+}
+
+// AdvSetE is like AdvSet, but fn can fail by returning an error, which is returned then.
+// The previous entry of the key stays intact and visible until fn succeeds. If fn returns
+// an error or panics, the new entry is discarded, and the panic is re-raised after the
+// lock released.
+//
+// It requires space for both the previous and the new entries, since the previous one is
+// pinned meanwhile, even beyond the pin limit.
+// It's safe to modify contents of key after AdvSetE returns.
+func (c *Cache) AdvSetE(key []byte, valLen int, fn func(val []byte) error) (bool, error) {
+	keyHash := c.hash(key)
+	return c.buckets[keyHash%BucketCount].SetE(key, keyHash, valLen, fn)
+}
+
 // Dump dumps all saved entires bucket by bucket in the order of insertion.
 // It's interrupted if f returns false。
 // The provided entry is read-only and never modify its key or value.
+// Negative entries set by SetMissing are dumped too, see ExtEntry.Missing.
 func (c *Cache) Dump(f func(Entry) bool) {
 	for i := 0; i < BucketCount; i++ {
 		if !c.buckets[i].Dump(f) {
@@ -3,8 +3,10 @@ package directcache_test
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/qianbin/directcache"
@@ -86,6 +88,185 @@ func TestCacheDump(t *testing.T) {
 	require.Equal(t, set, dumps)
 }
 
+func TestCacheNamespaces(t *testing.T) {
+	c := directcache.New(0)
+	c.SetNamespaces(func(key []byte) int {
+		if key[0] == 'k' {
+			return 0
+		}
+		return 1
+	}, []int{directcache.MinCapacity / 2, 0})
+
+	c.Set([]byte("k1"), []byte("v1"))
+	c.Set([]byte("k2"), []byte("v2"))
+	c.Set([]byte("x1"), []byte("v1"))
+	usage0, usage1 := c.NamespaceUsage(0), c.NamespaceUsage(1)
+	require.NotZero(t, usage0)
+	require.Equal(t, usage0/2, usage1)
+	require.Zero(t, c.NamespaceUsage(2))
+
+	c.Del([]byte("k1"))
+	require.Equal(t, usage1, c.NamespaceUsage(0))
+
+	c.Reset(0)
+	require.Zero(t, c.NamespaceUsage(0))
+}
+
+func TestCacheNamespaceQuota(t *testing.T) {
+	c := directcache.New(4 * 1024 * 1024)
+	ns := func(key []byte) int {
+		if key[0] == 'b' {
+			return 1
+		}
+		return 0
+	}
+	// quota of the batch namespace is 1/4 of the capacity
+	c.SetNamespaceWeights(ns, []int{3, 1})
+	val := make([]byte, 100)
+	key := func(prefix string, i int) []byte { return []byte(fmt.Sprintf("%s%d", prefix, i)) }
+
+	const n = 15000
+	for i := 0; i < n; i++ {
+		require.True(t, c.Set(key("api", i), val))
+	}
+	// the flood of batch entries stays within the quota, and never evicts api entries
+	for i := 0; i < n*10; i++ {
+		require.True(t, c.Set(key("batch", i), val))
+	}
+	require.True(t, c.NamespaceUsage(1) <= c.Capacity()/4)
+	require.True(t, c.NamespaceUsage(1) > c.Capacity()/5)
+	for i := 0; i < n; i++ {
+		require.True(t, c.Has(key("api", i)))
+	}
+	require.True(t, c.Has(key("batch", n*10-1)))
+	require.False(t, c.Has(key("batch", 0)))
+
+	// no limit for the namespace of non-positive weight
+	c.SetNamespaceWeights(ns, []int{0, 1})
+	require.True(t, c.Set(key("api", 0), make([]byte, c.Capacity()/directcache.BucketCount/2)))
+}
+
+func TestCacheStats(t *testing.T) {
+	c := directcache.New(0)
+	require.Equal(t, directcache.Stats{}, c.Stats())
+
+	c.Set([]byte("k1"), []byte("v1"))
+	c.Set([]byte("k2"), []byte("v2"))
+	require.Equal(t, 2, c.Len())
+	size := c.UsedBytes() / 2
+	require.Zero(t, c.DeadBytes())
+
+	// overwritten by larger value
+	c.Set([]byte("k1"), []byte("val1"))
+	require.Equal(t, 2, c.Len())
+	require.Equal(t, size, c.DeadBytes())
+	require.Equal(t, size*2+2, c.UsedBytes())
+
+	c.Del([]byte("k2"))
+	require.Equal(t, directcache.Stats{Len: 1, UsedBytes: size + 2, DeadBytes: size * 2}, c.Stats())
+
+	total := directcache.Stats{}
+	for i := 0; i < directcache.BucketCount; i++ {
+		s := c.BucketStats(i)
+		total.Len += s.Len
+		total.UsedBytes += s.UsedBytes
+		total.DeadBytes += s.DeadBytes
+	}
+	require.Equal(t, c.Stats(), total)
+}
+
+func TestCacheCompact(t *testing.T) {
+	c := directcache.New(0)
+	for i := 0; i < 100; i++ {
+		c.Set([]byte{'k', byte(i)}, []byte{'v'})
+	}
+	for i := 0; i < 100; i += 2 {
+		c.Del([]byte{'k', byte(i)})
+	}
+	dead := c.DeadBytes()
+	require.NotZero(t, dead)
+	require.Equal(t, dead, c.Compact())
+	require.Zero(t, c.DeadBytes())
+	require.Zero(t, c.Compact())
+	for i := 0; i < 100; i++ {
+		require.Equal(t, i%2 == 1, c.Has([]byte{'k', byte(i)}))
+	}
+
+	// background
+	stop := c.StartCompactor(time.Millisecond, 0)
+	defer stop()
+	for i := 1; i < 100; i += 2 {
+		c.Del([]byte{'k', byte(i)})
+	}
+	for deadline := time.Now().Add(time.Second); c.DeadBytes() > 0; {
+		require.True(t, time.Now().Before(deadline), "dead bytes should be reclaimed")
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+}
+
+func TestCacheEvictionContext(t *testing.T) {
+	c := directcache.New(0)
+	c.SetPushLimit(1)
+
+	buckets := map[int]bool{}
+	c.SetContextEvictionPolicy(func(entry directcache.Entry, ctx directcache.EvictionContext) bool {
+		require.Equal(t, 1, ctx.RetriesLeft)
+		require.True(t, ctx.Bucket >= 0 && ctx.Bucket < directcache.BucketCount)
+		buckets[ctx.Bucket] = true
+		return true
+	})
+	for i := 0; i < directcache.MinCapacity; i++ {
+		c.Set([]byte(fmt.Sprint(i)), nil)
+	}
+	require.Len(t, buckets, directcache.BucketCount)
+}
+
+func TestCacheSetWithCost(t *testing.T) {
+	c := directcache.New(0)
+	c.SetPolicy(directcache.PolicyGDSF)
+
+	require.True(t, c.SetWithCost([]byte("k1"), []byte("v1"), 100))
+	require.True(t, c.SetWithCost([]byte("k2"), []byte("v2"), -1))
+	require.True(t, c.Set([]byte("k3"), []byte("v3")))
+	require.True(t, c.SetWithCost([]byte("k4"), []byte("v4"), int(^uint(0)>>1)))
+
+	costs := map[string]int{}
+	c.Dump(func(e directcache.Entry) bool {
+		costs[string(e.Key())] = e.(directcache.ExtEntry).Cost()
+		return true
+	})
+	require.Equal(t, map[string]int{"k1": 100, "k2": 0, "k3": 1, "k4": math.MaxInt32}, costs)
+
+	got, ok := c.Get([]byte("k1"))
+	require.True(t, ok)
+	require.Equal(t, "v1", string(got))
+}
+
+func TestCacheMissingLimit(t *testing.T) {
+	c := directcache.New(1024 * 1024)
+	key := func(prefix string, i int) []byte { return []byte(fmt.Sprintf("%s%d", prefix, i)) }
+	const n = 10000
+	for i := 0; i < n; i++ {
+		require.True(t, c.Set(key("real", i), []byte("val")))
+	}
+	used := c.UsedBytes()
+
+	// a flood of negative entries leaves real entries resident
+	for i := 0; i < n*100; i++ {
+		c.SetMissing(key("missing", i))
+	}
+	for i := 0; i < n; i++ {
+		require.True(t, c.Has(key("real", i)))
+	}
+	require.Equal(t, used+c.Stats().MissingBytes, c.UsedBytes())
+	require.True(t, c.Stats().MissingBytes <= c.Capacity()/8)
+
+	c.SetMissingLimit(directcache.BucketCount * 10)
+	require.True(t, c.Stats().MissingBytes > directcache.BucketCount*10, "existing entries are kept")
+	require.False(t, c.SetMissing(key("more", 0)))
+}
+
 func BenchmarkCacheSetGet(b *testing.B) {
 	const nEntries = 1000000
 	b.Run("directcache", func(b *testing.B) {
@@ -133,3 +314,278 @@ func BenchmarkHash(b *testing.B) {
 		}
 	})
 }
+
+func TestCachePin(t *testing.T) {
+	c := directcache.New(0)
+	k := []byte("pinned")
+	require.False(t, c.Pin(k))
+	c.Set(k, []byte("v"))
+	require.True(t, c.Pin(k))
+	require.Equal(t, c.UsedBytes(), c.Stats().PinnedBytes)
+
+	// flood the cache
+	for i := 0; i < 100000; i++ {
+		c.Set([]byte(fmt.Sprint(i)), make([]byte, 100))
+	}
+	val, _ := c.Get(k)
+	require.Equal(t, []byte("v"), val)
+
+	require.True(t, c.Unpin(k))
+	require.False(t, c.Unpin(k))
+	require.Zero(t, c.Stats().PinnedBytes)
+
+	// limit split among buckets
+	c.SetPinLimit(1)
+	require.False(t, c.Pin(k))
+	c.SetPinLimit(0)
+	require.True(t, c.Pin(k))
+}
+
+func TestCacheCompareAndSet(t *testing.T) {
+	c := directcache.New(0)
+	k := []byte("k")
+	require.False(t, c.CompareAndSet(k, 0, []byte("v")))
+
+	c.Set(k, []byte("v1"))
+	val, ver, ok := c.GetWithVersion(k)
+	require.True(t, ok)
+	require.Equal(t, []byte("v1"), val)
+
+	require.True(t, c.CompareAndSet(k, ver, []byte("v2")))
+	require.False(t, c.CompareAndSet(k, ver, []byte("v3")))
+	require.False(t, c.CompareAndDelete(k, ver))
+
+	val, ver, _ = c.GetWithVersion(k)
+	require.Equal(t, []byte("v2"), val)
+	require.True(t, c.CompareAndDelete(k, ver))
+	require.False(t, c.Has(k))
+}
+
+func TestCacheDumpSince(t *testing.T) {
+	c := directcache.New(0)
+	replica := directcache.New(0)
+	replicate := func(cur directcache.Cursor) directcache.Cursor {
+		next, ok := c.DumpSince(cur, func(e directcache.Entry) bool {
+			replica.Set(e.Key(), e.Value())
+			return true
+		})
+		if !ok {
+			replica.Reset(replica.Capacity())
+			next, ok = c.DumpSince(directcache.Cursor{}, func(e directcache.Entry) bool {
+				replica.Set(e.Key(), e.Value())
+				return true
+			})
+			require.True(t, ok)
+		}
+		return next
+	}
+	dumpOf := func(c *directcache.Cache) map[string]string {
+		m := make(map[string]string)
+		c.Dump(func(e directcache.Entry) bool {
+			m[string(e.Key())] = string(e.Value())
+			return true
+		})
+		return m
+	}
+
+	var cur directcache.Cursor
+	for i := 0; i < 100; i++ {
+		c.Set([]byte(fmt.Sprint("k", i)), []byte(fmt.Sprint("v", i)))
+	}
+	cur = replicate(cur)
+	require.Equal(t, dumpOf(c), dumpOf(replica))
+
+	for i := 50; i < 150; i++ {
+		c.Set([]byte(fmt.Sprint("k", i)), []byte(fmt.Sprint("new", i)))
+	}
+	cur = replicate(cur)
+	require.Equal(t, dumpOf(c), dumpOf(replica))
+
+	c.Del([]byte("k0"))
+	cur = replicate(cur)
+	require.Equal(t, dumpOf(c), dumpOf(replica))
+
+	next, ok := c.DumpSince(cur, func(directcache.Entry) bool { panic("nothing changed") })
+	require.True(t, ok)
+	require.Equal(t, cur, next)
+}
+
+func TestCacheSample(t *testing.T) {
+	c := directcache.New(0)
+	for i := 0; i < 1000; i++ {
+		c.Set([]byte(fmt.Sprint(i)), []byte{'v'})
+	}
+
+	hits := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		n := 0
+		c.Sample(10, func(e directcache.Entry) bool {
+			hits[string(e.Key())]++
+			n++
+			return true
+		})
+		require.Equal(t, 10, n)
+	}
+	require.Greater(t, len(hits), 900)
+
+	n := 0
+	c.Sample(2000, func(e directcache.Entry) bool { n++; return true })
+	require.Equal(t, 1000, n)
+
+	n = 0
+	c.Sample(10, func(e directcache.Entry) bool { n++; return n < 3 })
+	require.Equal(t, 3, n)
+}
+
+func TestCacheConditional(t *testing.T) {
+	c := directcache.New(0)
+	k := []byte("k")
+
+	require.False(t, c.Replace(k, []byte("v1")))
+	require.False(t, c.Touch(k))
+	require.True(t, c.Add(k, []byte("v2")))
+
+	var recentlyUsed bool
+	dump := func() {
+		c.Dump(func(e directcache.Entry) bool {
+			recentlyUsed = e.RecentlyUsed()
+			return true
+		})
+	}
+	dump()
+	require.False(t, recentlyUsed)
+	require.True(t, c.Touch(k))
+	dump()
+	require.True(t, recentlyUsed)
+
+	require.False(t, c.Add(k, []byte("v3")))
+	require.True(t, c.AdvReplace(k, 2, func(val []byte) { copy(val, "v4") }))
+	require.False(t, c.AdvAdd(k, 2, func(val []byte) { panic("should not be called") }))
+
+	val, ok := c.Take(k)
+	require.True(t, ok)
+	require.Equal(t, []byte("v4"), val)
+	_, ok = c.Take(k)
+	require.False(t, ok)
+	require.False(t, c.AdvTake(k, func(val []byte) { panic("should not be called") }))
+}
+
+func TestCacheWatch(t *testing.T) {
+	c := directcache.New(0)
+	k := []byte("k")
+	events, cancel := c.Watch(k)
+	defer cancel()
+
+	c.Set(k, []byte("v1"))
+	c.Set(k, []byte("v2"))
+	c.Take(k)
+	for _, typ := range []directcache.EventType{directcache.EventSet, directcache.EventUpdate, directcache.EventDelete} {
+		ev := <-events
+		require.Equal(t, typ, ev.Type)
+		require.Equal(t, k, ev.Key)
+	}
+
+	cancel()
+	cancel()
+	_, ok := <-events
+	require.False(t, ok)
+	c.Set(k, []byte("v3"))
+	require.Zero(t, c.Stats().DroppedEvents)
+}
+
+func TestCacheAdvSetE(t *testing.T) {
+	c := directcache.New(0)
+	k := []byte("k")
+	c.Set(k, []byte("v1"))
+
+	errDecode := fmt.Errorf("decode")
+	ok, err := c.AdvSetE(k, 2, func(val []byte) error {
+		copy(val, "v2")
+		return errDecode
+	})
+	require.False(t, ok)
+	require.Equal(t, errDecode, err)
+	val, _ := c.Get(k)
+	require.Equal(t, []byte("v1"), val)
+
+	require.PanicsWithValue(t, "boom", func() {
+		c.AdvSetE(k, 2, func(val []byte) error { panic("boom") })
+	})
+	val, _ = c.Get(k)
+	require.Equal(t, []byte("v1"), val)
+
+	ok, err = c.AdvSetE(k, 2, func(val []byte) error {
+		copy(val, "v3")
+		return nil
+	})
+	require.True(t, ok)
+	require.NoError(t, err)
+	val, _ = c.Get(k)
+	require.Equal(t, []byte("v3"), val)
+}
+
+func TestCacheSetWithMeta(t *testing.T) {
+	c := directcache.New(0)
+	k := []byte("k")
+	c.Set(k, []byte("v0"))
+	_, meta, ok := c.GetWithMeta(k)
+	require.True(t, ok)
+	require.Zero(t, meta)
+
+	require.True(t, c.SetWithMeta(k, []byte("v1"), 42))
+	val, meta, ok := c.GetWithMeta(k)
+	require.True(t, ok)
+	require.Equal(t, []byte("v1"), val)
+	require.Equal(t, uint32(42), meta)
+
+	c.Dump(func(e directcache.Entry) bool {
+		require.Equal(t, uint32(42), e.(directcache.ExtEntry).Meta())
+		return true
+	})
+
+	// in-place update
+	require.True(t, c.SetWithMeta(k, []byte("v2"), 43))
+	_, meta, _ = c.GetWithMeta(k)
+	require.Equal(t, uint32(43), meta)
+	require.Equal(t, 1, c.Len())
+
+	c.Set(k, []byte("v3"))
+	_, meta, _ = c.GetWithMeta(k)
+	require.Zero(t, meta)
+	_, _, ok = c.GetWithMeta([]byte("missing"))
+	require.False(t, ok)
+}
+
+func TestCacheSetMissing(t *testing.T) {
+	c := directcache.New(0)
+	k := []byte("k")
+	_, res := c.Lookup(k)
+	require.Equal(t, directcache.LookupUnknown, res)
+
+	require.True(t, c.SetMissing(k))
+	val, res := c.Lookup(k)
+	require.Equal(t, directcache.LookupMissing, res)
+	require.Nil(t, val)
+	require.False(t, c.Has(k))
+	_, ok := c.Get(k)
+	require.False(t, ok)
+	require.True(t, c.Add(k, []byte{}), "missing key is absent")
+
+	// empty value is distinct
+	val, res = c.Lookup(k)
+	require.Equal(t, directcache.LookupFound, res)
+	require.Empty(t, val)
+
+	c.SetMissing(k)
+	require.Equal(t, 1, c.Len(), "negative entries are counted")
+	dumped := 0
+	c.Dump(func(e directcache.Entry) bool {
+		require.True(t, e.(directcache.ExtEntry).Missing())
+		dumped++
+		return true
+	})
+	require.Equal(t, 1, dumped)
+	require.True(t, c.Del(k))
+	_, res = c.Lookup(k)
+	require.Equal(t, directcache.LookupUnknown, res)
+}
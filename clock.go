@@ -0,0 +1,26 @@
+package directcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clock is the coarse clock in seconds, which saves calling time.Now on each write.
+var clock struct {
+	once sync.Once
+	now  uint32
+}
+
+// now returns the unix time in seconds of the coarse clock.
+func now() uint32 {
+	clock.once.Do(func() {
+		atomic.StoreUint32(&clock.now, uint32(time.Now().Unix()))
+		go func() {
+			for t := range time.Tick(time.Second) {
+				atomic.StoreUint32(&clock.now, uint32(t.Unix()))
+			}
+		}()
+	})
+	return atomic.LoadUint32(&clock.now)
+}
@@ -0,0 +1,17 @@
+package directcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_clock(t *testing.T) {
+	n := int64(now())
+	require.InDelta(t, time.Now().Unix(), n, 1)
+	for deadline := time.Now().Add(3 * time.Second); int64(now()) == n; {
+		require.True(t, time.Now().Before(deadline), "clock should tick")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
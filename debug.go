@@ -0,0 +1,7 @@
+//go:build directcache_debug
+// +build directcache_debug
+
+package directcache
+
+// debug enables expensive sanity checks, e.g. hashes passed to GetHashed.
+const debug = true
@@ -3,21 +3,129 @@ package directcache
 import (
 	"encoding/binary"
 	"math"
+	"time"
 )
 
 const (
 	deletedFlag      = 1 // the entry was deleted
 	recentlyUsedFlag = 2 // the entry is recently accessed
+	hotFlag          = 4 // the entry is in the main queue of S3-FIFO, or hot in CLOCK-Pro
+	pinnedFlag       = 8 // the entry is pinned and never evicted
 )
 
+// MaxFrequency is the max value of the entry access frequency counter.
+const MaxFrequency = 3
+
 // Entry presents the entry of a key-value pair.
 type Entry interface {
 	Key() []byte
 	Value() []byte
 	RecentlyUsed() bool
+	// Frequency returns the saturating access counter in range [0, MaxFrequency].
+	// It's increased when the entry is accessed, and decreased when the entry
+	// survives an eviction.
+	Frequency() int
+}
+
+// ExtEntry extends Entry with more details.
+// Entries provided by Cache can be type-asserted to ExtEntry.
+type ExtEntry interface {
+	Entry
+	// Size returns bytes the entry occupies, including the header.
+	Size() int
+	// InsertedAt returns the time when the entry was inserted or last updated,
+	// in minutes precision. It's kept in 16 bits, so entries older than about
+	// 45 days report a later time.
+	InsertedAt() time.Time
+	// Seq returns the low 32 bits of the sequence number of the write to the entry.
+	// It wraps around every 2^32 writes to the bucket. The full sequence number is
+	// the version returned by GetWithVersion.
+	Seq() uint64
+	// Cost returns the cost to recompute the entry, which is set by SetWithCost,
+	// or 1 by default.
+	Cost() int
+	// Missing returns true if the entry is a negative one set by SetMissing,
+	// which has no value.
+	Missing() bool
+	// Meta returns the caller-defined metadata set by SetWithMeta, or 0 if not set.
+	Meta() uint32
+	// Stale returns true if the entry passed the soft deadline set by SetWithTTL.
+	Stale() bool
+	// Expired returns true if the entry passed the hard deadline set by SetWithTTL.
+	// Expired entries are invisible to reads.
+	Expired() bool
+}
+
+// ext presents optional header fields. Each field present is indicated by a flag.
+type ext struct {
+	flags   byte
+	cost    uint32
+	meta    uint32
+	softTTL uint32
+	hardTTL uint32
+}
+
+// flags of optional header fields.
+const (
+	costExt    = 1 // 4 bytes cost
+	metaExt    = 2 // 4 bytes caller-defined metadata
+	missingExt = 4 // no field, the entry records that the key is missing
+	ttlExt     = 8 // 12 bytes time of the write, soft TTL and hard TTL in seconds, 0 for no deadline
+)
+
+// extSize returns the size of optional header fields present.
+func extSize(flags byte) int {
+	n := 0
+	if flags&costExt != 0 {
+		n += 4
+	}
+	if flags&metaExt != 0 {
+		n += 4
+	}
+	if flags&ttlExt != 0 {
+		n += 12
+	}
+	return n
+}
+
+// Flags returns flags of fields present. It's safe to call on nil x.
+func (x *ext) Flags() byte {
+	if x == nil {
+		return 0
+	}
+	return x.flags
 }
 
+// put writes fields in order to b.
+func (x *ext) put(b []byte) {
+	if x.flags&costExt != 0 {
+		binary.BigEndian.PutUint32(b, x.cost)
+		b = b[4:]
+	}
+	if x.flags&metaExt != 0 {
+		binary.BigEndian.PutUint32(b, x.meta)
+		b = b[4:]
+	}
+	if x.flags&ttlExt != 0 {
+		// the time of the write is set by SetStamp
+		binary.BigEndian.PutUint32(b[4:], x.softTTL)
+		binary.BigEndian.PutUint32(b[8:], x.hardTTL)
+	}
+}
+
+// stampSize is the size of the stamp in header, which consists of the low
+// 16 bits of unix time in minutes and the low 32 bits of write sequence.
+const stampSize = 2 + 4
+
 // entry consists of header and body.
+//
+// The header is laid out as:
+//
+//	e[0]     flags, frequency counter and length width
+//	e[1]     flags of optional header fields
+//	lw*3     key length, val length and spare
+//	6 bytes  stamp
+//	...      optional header fields
 type entry []byte
 
 // flag ops. flags are stored in the first 4 bits of e[0].
@@ -28,14 +136,133 @@ func (e entry) RemoveFlag(flag uint8)   { e[0] &^= (flag << 4) }
 // RecentlyUsed complies Entry interface.
 func (e entry) RecentlyUsed() bool { return e.HasFlag(recentlyUsedFlag) }
 
+// frequency ops. the access frequency counter is stored in bits 2-3 of e[0].
+func (e entry) Frequency() int { return int(e[0]>>2) & MaxFrequency }
+
+// IncFrequency is called by readers concurrently, so e[0] is loaded and stored once,
+// and the increment never carries into flags. A racing increment or recently-used
+// flag may be lost, but other flags are kept, since only writers change them.
+func (e entry) IncFrequency() {
+	if h := e[0]; (h>>2)&MaxFrequency < MaxFrequency {
+		e[0] = h + 1<<2
+	}
+}
+func (e entry) DecFrequency() {
+	if e.Frequency() > 0 {
+		e[0] -= 1 << 2
+	}
+}
+
 // lw extracts the number of bytes to present key/val length.
 // It's stored in the last 2 bits of e[0].
 func (e entry) lw() int { return 1 << (e[0] & 3) }
 
-func (e entry) hdrSize() int { return 1 + e.lw()*3 }
-func (e entry) keyLen() int  { return e.intAt(1, e.lw()) }
-func (e entry) valLen() int  { return e.intAt(1+e.lw(), e.lw()) }
-func (e entry) spare() int   { return e.intAt(1+e.lw()*2, e.lw()) }
+// extFlags returns flags of optional header fields, which are stored in e[1].
+func (e entry) extFlags() byte { return e[1] }
+
+func (e entry) hdrSize() int { return 2 + e.lw()*3 + stampSize + extSize(e.extFlags()) }
+func (e entry) keyLen() int  { return e.intAt(2, e.lw()) }
+func (e entry) valLen() int  { return e.intAt(2+e.lw(), e.lw()) }
+func (e entry) spare() int   { return e.intAt(2+e.lw()*2, e.lw()) }
+
+// stamp is placed after key/val length and spare.
+func (e entry) stamp() []byte { return e[2+e.lw()*3:][:stampSize] }
+
+// ext returns optional header fields placed after the stamp.
+func (e entry) ext() []byte { return e[2+e.lw()*3+stampSize:][:extSize(e.extFlags())] }
+
+// InsertedAt returns the time when the entry was written. It's the latest minute
+// not after now, which matches the low 16 bits kept.
+func (e entry) InsertedAt() time.Time {
+	m := now() / 60
+	m -= uint32(uint16(m) - binary.BigEndian.Uint16(e.stamp()))
+	return time.Unix(int64(m)*60, 0)
+}
+
+// Seq returns the low 32 bits of the write sequence.
+func (e entry) Seq() uint64 { return uint64(binary.BigEndian.Uint32(e.stamp()[2:])) }
+
+// SetStamp sets the time in seconds and sequence of the write.
+// The full time is also kept if the entry has TTLs.
+func (e entry) SetStamp(ts uint32, seq uint64) {
+	s := e.stamp()
+	binary.BigEndian.PutUint16(s, uint16(ts/60))
+	binary.BigEndian.PutUint32(s[2:], uint32(seq))
+	if e.extFlags()&ttlExt != 0 {
+		binary.BigEndian.PutUint32(e.extField(ttlExt), ts)
+	}
+}
+
+// Cost returns the cost of the entry, which is 1 if not set.
+func (e entry) Cost() int {
+	if e.extFlags()&costExt == 0 {
+		return 1
+	}
+	return int(binary.BigEndian.Uint32(e.ext()))
+}
+
+// Missing returns true if the entry is a negative one.
+func (e entry) Missing() bool { return e.extFlags()&missingExt != 0 }
+
+// Meta returns the caller-defined metadata, which is 0 if not set.
+func (e entry) Meta() uint32 {
+	flags := e.extFlags()
+	if flags&metaExt == 0 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(e.extField(metaExt))
+}
+
+// extField returns the optional header field of the flag, which is placed after
+// fields of lower flags.
+func (e entry) extField(flag byte) []byte {
+	return e.ext()[extSize(e.extFlags()&(flag-1)):]
+}
+
+// extValues decodes optional header fields.
+func (e entry) extValues() ext {
+	x := ext{flags: e.extFlags()}
+	if x.flags&costExt != 0 {
+		x.cost = binary.BigEndian.Uint32(e.extField(costExt))
+	}
+	if x.flags&metaExt != 0 {
+		x.meta = binary.BigEndian.Uint32(e.extField(metaExt))
+	}
+	x.softTTL, x.hardTTL, _ = e.ttls()
+	return x
+}
+
+// ttls returns the soft and hard TTLs in seconds. false is returned if not set.
+func (e entry) ttls() (soft, hard uint32, ok bool) {
+	if e.extFlags()&ttlExt == 0 {
+		return 0, 0, false
+	}
+	f := e.extField(ttlExt)
+	return binary.BigEndian.Uint32(f[4:]), binary.BigEndian.Uint32(f[8:]), true
+}
+
+// Stale returns true if the soft deadline passed.
+func (e entry) Stale() bool {
+	soft, _, ok := e.ttls()
+	return ok && soft > 0 && e.age() >= soft
+}
+
+// Expired returns true if the hard deadline passed.
+func (e entry) Expired() bool {
+	_, hard, ok := e.ttls()
+	return ok && hard > 0 && e.age() >= hard
+}
+
+// age returns seconds since the entry with TTLs was written.
+func (e entry) age() uint32 {
+	if ts, n := binary.BigEndian.Uint32(e.extField(ttlExt)), now(); n > ts {
+		return n - ts
+	}
+	return 0
+}
+
+// readable returns true if the entry has a value which is not expired.
+func (e entry) readable() bool { return !e.Missing() && !e.Expired() }
 
 // Size returns the entry size.
 func (e entry) Size() int { return e.hdrSize() + e.keyLen() + e.valLen() + e.spare() }
@@ -53,22 +280,53 @@ func (e entry) Value() []byte { return e[e.hdrSize():][e.keyLen():][:e.valLen()]
 //
 // The entry must be pre-alloced.
 func (e entry) Init(key []byte, valLen int, spare int) []byte {
-	keyLen := len(key)
+	return e.InitExt(key, valLen, spare, nil)
+}
+
+// InitExt is like Init, and also initializes optional header fields if x is not nil.
+func (e entry) InitExt(key []byte, valLen int, spare int, x *ext) []byte {
+	return e.InitV([][]byte{key}, valLen, spare, x)
+}
+
+// InitV is like InitExt, with the key given in parts.
+func (e entry) InitV(keyParts [][]byte, valLen int, spare int, x *ext) []byte {
+	keyLen := partsLen(keyParts)
 	lb := bitw(keyLen + valLen + spare)
 
 	// init header
 	e[0] = lb
+	e[1] = x.Flags()
 	lw := 1 << lb
-	e.setIntAt(1, lw, keyLen)
-	e.setIntAt(1+lw, lw, valLen)
-	e.setIntAt(1+lw*2, lw, spare)
+	e.setIntAt(2, lw, keyLen)
+	e.setIntAt(2+lw, lw, valLen)
+	e.setIntAt(2+lw*2, lw, spare)
+	if x != nil {
+		x.put(e.ext())
+	}
 
 	// init key and value
-	hdrSize := 1 + lw*3
-	copy(e[hdrSize:], key)
+	hdrSize := 2 + lw*3 + stampSize + extSize(e[1])
+	n := hdrSize
+	for _, part := range keyParts {
+		n += copy(e[n:], part)
+	}
 	return e[hdrSize:][keyLen:][:valLen]
 }
 
+// Reinit re-initializes the entry with the same body size and optional header fields,
+// and keeps flags and the frequency counter.
+func (e entry) Reinit(key []byte, valLen int, spare int, x *ext) []byte {
+	return e.ReinitV([][]byte{key}, valLen, spare, x)
+}
+
+// ReinitV is like Reinit, with the key given in parts.
+func (e entry) ReinitV(keyParts [][]byte, valLen int, spare int, x *ext) []byte {
+	hdr := e[0]
+	val := e.InitV(keyParts, valLen, spare, x)
+	e[0] = hdr
+	return val
+}
+
 func (e entry) intAt(i int, w int) int {
 	switch w {
 	case 1:
@@ -93,7 +351,12 @@ func (e entry) setIntAt(i int, w int, n int) {
 
 // entrySize returns the size of an entry for given kv lengths.
 func entrySize(keyLen, valLen, spare int) int {
-	return 1 + (3 << bitw(keyLen+valLen+spare)) + // hdr
+	return entrySizeExt(keyLen, valLen, spare, 0)
+}
+
+// entrySizeExt returns the size of an entry for given kv lengths and optional header fields.
+func entrySizeExt(keyLen, valLen, spare int, extFlags byte) int {
+	return 2 + (3 << bitw(keyLen+valLen+spare)) + stampSize + extSize(extFlags) + // hdr
 		keyLen + valLen + spare //body
 }
 
@@ -3,6 +3,7 @@ package directcache
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -121,4 +122,84 @@ func Test_entry(t *testing.T) {
 		ent.RemoveFlag(deletedFlag)
 		require.False(t, ent.HasFlag(deletedFlag))
 	})
+
+	t.Run("frequency", func(t *testing.T) {
+		key := strings.Repeat("s", 1000)
+		val := "bar"
+
+		ent := make(entry, entrySize(len(key), len(val), 0))
+		copy(ent.Init([]byte(key), len(val), 0), val)
+		ent.AddFlag(recentlyUsedFlag)
+
+		require.Zero(t, ent.Frequency())
+		ent.DecFrequency()
+		require.Zero(t, ent.Frequency())
+		for i := 0; i < MaxFrequency+1; i++ {
+			ent.IncFrequency()
+		}
+		require.Equal(t, MaxFrequency, ent.Frequency())
+		ent.DecFrequency()
+		require.Equal(t, MaxFrequency-1, ent.Frequency())
+		copy(ent.Reinit([]byte(key), len(val), 0, nil), val)
+		require.Equal(t, MaxFrequency-1, ent.Frequency(), "kept by reinit")
+
+		// other fields untouched
+		require.True(t, ent.RecentlyUsed())
+		require.Equal(t, key, string(ent.Key()))
+		require.Equal(t, val, string(ent.Value()))
+	})
+
+	t.Run("stamp", func(t *testing.T) {
+		key := "foo"
+		val := "bar"
+
+		var ent ExtEntry = make(entry, entrySize(len(key), len(val), 0))
+		copy(ent.(entry).Init([]byte(key), len(val), 0), val)
+
+		ts := time.Unix(int64(now()), 0).Add(-time.Hour)
+		ent.(entry).SetStamp(uint32(ts.Unix()), 1<<32+1)
+		require.Equal(t, ts.Truncate(time.Minute), ent.InsertedAt(), "in minutes precision")
+		require.Equal(t, uint64(1), ent.Seq(), "low 32 bits kept")
+		require.Equal(t, entrySize(len(key), len(val), 0), ent.Size())
+		require.Equal(t, 2+3+stampSize+len(key)+len(val), ent.Size())
+		require.Equal(t, key, string(ent.Key()))
+		require.Equal(t, val, string(ent.Value()))
+	})
+
+	t.Run("ext", func(t *testing.T) {
+		key := "foo"
+		val := "bar"
+		x := &ext{flags: costExt, cost: 100}
+
+		ent := make(entry, entrySizeExt(len(key), len(val), 0, x.flags))
+		copy(ent.InitExt([]byte(key), len(val), 0, x), val)
+		require.Equal(t, entrySize(len(key), len(val), 0)+4, ent.Size())
+		require.Equal(t, 100, ent.Cost())
+		require.Equal(t, key, string(ent.Key()))
+		require.Equal(t, val, string(ent.Value()))
+
+		x.cost = 200
+		copy(ent.Reinit([]byte(key), len(val), 0, x), val)
+		require.Equal(t, 200, ent.Cost())
+		require.Equal(t, val, string(ent.Value()))
+
+		ent = make(entry, entrySize(len(key), len(val), 0))
+		ent.Init([]byte(key), len(val), 0)
+		require.Equal(t, 1, ent.Cost(), "default cost")
+		require.Zero(t, ent.Meta(), "default meta")
+
+		for _, tt := range []struct {
+			x    *ext
+			cost int
+		}{
+			{&ext{flags: metaExt, meta: 42}, 1},
+			{&ext{flags: costExt | metaExt, cost: 100, meta: 42}, 100},
+		} {
+			ent := make(entry, entrySizeExt(len(key), len(val), 0, tt.x.flags))
+			copy(ent.InitExt([]byte(key), len(val), 0, tt.x), val)
+			require.Equal(t, uint32(42), ent.Meta())
+			require.Equal(t, tt.cost, ent.Cost())
+			require.Equal(t, val, string(ent.Value()))
+		}
+	})
 }
@@ -0,0 +1,97 @@
+package directcache
+
+import (
+	"math"
+	"time"
+)
+
+// SetWithTTL is like Set, and the entry is stored with soft and hard TTLs, in seconds
+// precision. After the soft TTL, the entry becomes stale, and GetFresh refreshes it in
+// background. After the hard TTL, the entry expires and is invisible to reads.
+// A non-positive TTL means no deadline.
+func (c *Cache) SetWithTTL(key, val []byte, soft, hard time.Duration) bool {
+	keyHash := c.hash(key)
+	x := ext{flags: ttlExt, softTTL: ttlSeconds(soft), hardTTL: ttlSeconds(hard)}
+	return c.buckets[keyHash%BucketCount].SetExt(key, keyHash, len(val), &x, func(_val []byte) {
+		copy(_val, val)
+	})
+}
+
+// GetFresh is like Get, but if the entry is stale, which passed its soft deadline set by
+// SetWithTTL, the stale value is returned immediately and the entry is refreshed in background
+// by calling refresh. Refreshes are de-duplicated per key. The refreshed value replaces the entry
+// with the same TTLs, unless the entry is written by others in the meantime. The stale value is
+// kept if refresh returns an error.
+//
+// It returns false if no matched entry, or the entry expired. The caller should load the value
+// and set it with SetWithTTL then.
+func (c *Cache) GetFresh(key []byte, refresh func() ([]byte, error)) (val []byte, ok bool) {
+	keyHash := c.hash(key)
+	var (
+		stale   bool
+		version uint64
+		x       ext
+	)
+	bkt := &c.buckets[keyHash%BucketCount]
+	bkt.GetExt(key, keyHash, func(ent entry) {
+		if ok = !ent.Missing(); ok {
+			val = append(val, ent.Value()...)
+			if stale = ent.Stale(); stale {
+				version, x = bkt.seqOf(ent), ent.extValues()
+			}
+		}
+	}, false)
+	if stale {
+		c.refresh(key, version, x, refresh)
+	}
+	return
+}
+
+// refresh starts the background refresh of the entry of the given version,
+// unless the key is being refreshed.
+func (c *Cache) refresh(key []byte, version uint64, x ext, refresh func() ([]byte, error)) {
+	k := string(key)
+	c.refreshLock.Lock()
+	if c.refreshing[k] {
+		c.refreshLock.Unlock()
+		return
+	}
+	if c.refreshing == nil {
+		c.refreshing = make(map[string]bool)
+	}
+	c.refreshing[k] = true
+	c.refreshLock.Unlock()
+
+	go func() {
+		defer func() {
+			c.refreshLock.Lock()
+			delete(c.refreshing, k)
+			c.refreshLock.Unlock()
+		}()
+		val, err := refresh()
+		if err != nil {
+			return
+		}
+		// hash again, since hash tags may be switched meanwhile
+		key := []byte(k)
+		keyHash := c.hash(key)
+		c.buckets[keyHash%BucketCount].CompareAndSet(key, keyHash, version, len(val), &x, func(_val []byte) {
+			copy(_val, val)
+		})
+	}()
+}
+
+// ttlSeconds converts the TTL to seconds, rounded up.
+func ttlSeconds(ttl time.Duration) uint32 {
+	if ttl <= 0 {
+		return 0
+	}
+	s := ttl / time.Second
+	if ttl%time.Second != 0 {
+		s++
+	}
+	if s < math.MaxUint32 {
+		return uint32(s)
+	}
+	return math.MaxUint32
+}
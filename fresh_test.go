@@ -0,0 +1,115 @@
+package directcache
+
+import (
+	"errors"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheGetFresh(t *testing.T) {
+	c := New(0)
+	k := []byte("k")
+	// age ages the entry by the given seconds
+	age := func(secs uint32) {
+		keyHash := c.hash(k)
+		bkt := &c.buckets[keyHash%BucketCount]
+		bkt.lock.Lock()
+		defer bkt.lock.Unlock()
+		ent, _ := bkt.lookup(k, keyHash)
+		ent.SetStamp(now()-secs, ent.Seq())
+	}
+	var calls int32
+	refreshed := make(chan struct{}, 10)
+	refresh := func(val string, err error) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			atomic.AddInt32(&calls, 1)
+			defer func() { refreshed <- struct{}{} }()
+			return []byte(val), err
+		}
+	}
+	waitRefreshed := func() {
+		<-refreshed
+		// wait for the refreshing flag cleared
+		for {
+			c.refreshLock.Lock()
+			n := len(c.refreshing)
+			c.refreshLock.Unlock()
+			if n == 0 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	_, ok := c.GetFresh(k, refresh("v", nil))
+	require.False(t, ok)
+
+	require.True(t, c.SetWithTTL(k, []byte("v1"), 10*time.Second, time.Minute))
+	val, ok := c.GetFresh(k, refresh("v2", nil))
+	require.True(t, ok)
+	require.Equal(t, []byte("v1"), val, "fresh")
+	require.Zero(t, atomic.LoadInt32(&calls))
+
+	// stale value served, and refreshed in background
+	age(10)
+	val, _ = c.GetFresh(k, refresh("v2", nil))
+	require.Equal(t, []byte("v1"), val)
+	waitRefreshed()
+	val, _ = c.GetFresh(k, refresh("v3", nil))
+	require.Equal(t, []byte("v2"), val)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// TTLs kept
+	age(10)
+	blocked := make(chan struct{})
+	slow := func() ([]byte, error) {
+		<-blocked
+		return refresh("v4", nil)()
+	}
+	for i := 0; i < 5; i++ {
+		val, _ = c.GetFresh(k, slow)
+		require.Equal(t, []byte("v2"), val)
+	}
+	close(blocked)
+	waitRefreshed()
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls), "de-duplicated")
+	val, _ = c.Get(k)
+	require.Equal(t, []byte("v4"), val)
+
+	// stale value kept on error
+	age(10)
+	c.GetFresh(k, refresh("", errors.New("db down")))
+	waitRefreshed()
+	val, _ = c.Get(k)
+	require.Equal(t, []byte("v4"), val)
+
+	// not overwriting newer writes
+	age(10)
+	blocked = make(chan struct{})
+	c.GetFresh(k, slow)
+	c.SetWithTTL(k, []byte("v5"), 10*time.Second, time.Minute)
+	close(blocked)
+	waitRefreshed()
+	val, _ = c.Get(k)
+	require.Equal(t, []byte("v5"), val)
+
+	// expired
+	age(60)
+	_, ok = c.GetFresh(k, refresh("v6", nil))
+	require.False(t, ok)
+	require.False(t, c.Has(k))
+	_, res := c.Lookup(k)
+	require.Equal(t, LookupUnknown, res)
+}
+
+func Test_ttlSeconds(t *testing.T) {
+	require.Equal(t, uint32(0), ttlSeconds(-time.Second))
+	require.Equal(t, uint32(0), ttlSeconds(0))
+	require.Equal(t, uint32(1), ttlSeconds(time.Millisecond))
+	require.Equal(t, uint32(2), ttlSeconds(2*time.Second))
+	require.Equal(t, uint32(math.MaxUint32), ttlSeconds(time.Duration(math.MaxInt64)))
+}
@@ -0,0 +1,46 @@
+package directcache
+
+// ghost remembers hashes of recently evicted keys approximately.
+// A hash slot is overwritten by newer keys, so that old keys are forgotten gradually.
+type ghost struct {
+	slots []uint32 // fingerprints of key hashes, zero for empty
+	shift uint     // 64 - log2(len(slots))
+}
+
+// Reset resets the ghost with room for about n keys, and forgets all keys.
+func (g *ghost) Reset(n int) {
+	size, shift := 64, uint(58)
+	for size < n {
+		size <<= 1
+		shift--
+	}
+	g.slots = make([]uint32, size)
+	g.shift = shift
+}
+
+// Len returns the count of slots.
+func (g *ghost) Len() int { return len(g.slots) }
+
+func (g *ghost) slot(keyHash uint64) (*uint32, uint32) {
+	i := (keyHash * 0x9e3779b97f4a7c15) >> g.shift
+	return &g.slots[i], uint32(keyHash>>32) | 1
+}
+
+// Add remembers the key hash.
+func (g *ghost) Add(keyHash uint64) {
+	if len(g.slots) > 0 {
+		p, fp := g.slot(keyHash)
+		*p = fp
+	}
+}
+
+// Take forgets the key hash and returns whether it was remembered.
+func (g *ghost) Take(keyHash uint64) bool {
+	if len(g.slots) > 0 {
+		if p, fp := g.slot(keyHash); *p == fp {
+			*p = 0
+			return true
+		}
+	}
+	return false
+}
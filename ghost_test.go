@@ -0,0 +1,28 @@
+package directcache
+
+import (
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ghost(t *testing.T) {
+	var g ghost
+	g.Add(1) // no-op
+	require.False(t, g.Take(1))
+
+	g.Reset(100)
+	require.Equal(t, 128, g.Len())
+
+	a, b := xxhash.Sum64String("a"), xxhash.Sum64String("b")
+	g.Add(a)
+	require.False(t, g.Take(b))
+	require.True(t, g.Take(a))
+	require.False(t, g.Take(a), "taken")
+
+	g.Add(b)
+	g.Reset(10)
+	require.Equal(t, 64, g.Len())
+	require.False(t, g.Take(b), "forgotten after reset")
+}
@@ -0,0 +1,42 @@
+package directcache
+
+import "errors"
+
+// Hash returns the hash of the key, which is for APIs taking precomputed hashes, e.g. GetHashed.
+// It takes hash tags into account if enabled.
+func (c *Cache) Hash(key []byte) uint64 { return c.hash(key) }
+
+// GetHashed is like Get, with the precomputed keyHash returned by Hash.
+func (c *Cache) GetHashed(key []byte, keyHash uint64) (val []byte, ok bool) {
+	ok = c.AdvGetHashed(key, keyHash, func(_val []byte) {
+		val = append(val, _val...)
+	}, false)
+	return
+}
+
+// AdvGetHashed is like AdvGet, with the precomputed keyHash returned by Hash.
+func (c *Cache) AdvGetHashed(key []byte, keyHash uint64, fn func(val []byte), peek bool) bool {
+	c.checkHash(key, keyHash)
+	return c.buckets[keyHash%BucketCount].Get(key, keyHash, fn, peek)
+}
+
+// SetHashed is like Set, with the precomputed keyHash returned by Hash.
+func (c *Cache) SetHashed(key []byte, keyHash uint64, val []byte) bool {
+	c.checkHash(key, keyHash)
+	return c.buckets[keyHash%BucketCount].Set(key, keyHash, len(val), func(_val []byte) {
+		copy(_val, val)
+	})
+}
+
+// DelHashed is like Del, with the precomputed keyHash returned by Hash.
+func (c *Cache) DelHashed(key []byte, keyHash uint64) bool {
+	c.checkHash(key, keyHash)
+	return c.buckets[keyHash%BucketCount].Del(key, keyHash)
+}
+
+// checkHash panics if keyHash mismatches the key in debug builds.
+func (c *Cache) checkHash(key []byte, keyHash uint64) {
+	if debug && c.hash(key) != keyHash {
+		panic(errors.New("directcache: key hash mismatched"))
+	}
+}
@@ -0,0 +1,41 @@
+package directcache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheHashed(t *testing.T) {
+	c := New(0)
+	k := []byte("user:{42}:profile")
+	h := c.Hash(k)
+
+	require.True(t, c.SetHashed(k, h, []byte("v1")))
+	val, ok := c.Get(k)
+	require.True(t, ok)
+	require.Equal(t, []byte("v1"), val)
+
+	c.Set(k, []byte("v2"))
+	val, ok = c.GetHashed(k, h)
+	require.True(t, ok)
+	require.Equal(t, []byte("v2"), val)
+	require.True(t, c.AdvGetHashed(k, h, func(val []byte) {
+		require.Equal(t, []byte("v2"), val)
+	}, true))
+
+	require.True(t, c.DelHashed(k, h))
+	require.False(t, c.Has(k))
+
+	c.SetHashTags(true)
+	require.NotEqual(t, h, c.Hash(k))
+	require.True(t, c.SetHashed(k, c.Hash(k), []byte("v3")))
+	require.True(t, c.Has(k))
+
+	if debug {
+		require.Panics(t, func() { c.GetHashed(k, h) })
+	} else {
+		_, ok = c.GetHashed(k, h)
+		require.False(t, ok)
+	}
+}
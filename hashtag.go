@@ -0,0 +1,117 @@
+package directcache
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// hashTag returns the substring inside the first {} of the key, in the style of
+// Redis Cluster hash tags. nil is returned if no tag or the tag is empty.
+func hashTag(key []byte) []byte {
+	if i := bytes.IndexByte(key, '{'); i >= 0 {
+		if j := bytes.IndexByte(key[i+1:], '}'); j > 0 {
+			return key[i+1:][:j]
+		}
+	}
+	return nil
+}
+
+// hashKey hashes the key. If tags is true and the key has a hash tag, the bits
+// selecting the bucket are taken from the hash of the tag.
+func hashKey(key []byte, tags bool) uint64 {
+	h := xxhash.Sum64(key)
+	if tags {
+		if tag := hashTag(key); tag != nil {
+			return h&^(BucketCount-1) | xxhash.Sum64(tag)&(BucketCount-1)
+		}
+	}
+	return h
+}
+
+// setHashTags sets whether hash tags are used, and returns watchers taken out of the bucket.
+// It clears the bucket, since entries and watchers are indexed by hashes. It's lock-free.
+func (b *bucket) setHashTags(enabled bool) []*watcher {
+	b.reset(b.q.Cap())
+	b.hashTags = enabled
+	var ws []*watcher
+	for _, w := range b.watchers {
+		ws = append(ws, w...)
+	}
+	b.watchers = nil
+	return ws
+}
+
+// DelGroup deletes keys of the hash tag, and returns the count of deleted keys.
+func (b *bucket) DelGroup(tag []byte) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	n := 0
+	b.each(func(ent entry) bool {
+		if key := ent.Key(); bytes.Equal(hashTag(key), tag) {
+			b.del(ent, hashKey(key, b.hashTags))
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// SetHashTags enables or disables hash tags. If enabled, keys with the same hash tag,
+// which is the substring inside the first {} of the key, e.g. "42" of "user:{42}:profile",
+// are stored in the same bucket, so that a Txn over them takes only one lock. The full key
+// is still hashed for the index.
+//
+// Entries are cleared since the option affects the placement of keys, and watchers are
+// moved to buckets of their keys. Writes racing with SetHashTags may leave entries
+// unreachable until evicted, so it's better called before the cache is used.
+func (c *Cache) SetHashTags(enabled bool) {
+	// lock all buckets in ascending order like Txn, so that nobody sees entries or
+	// watchers indexed in the other way.
+	for i := 0; i < BucketCount; i++ {
+		c.buckets[i].lock.Lock()
+	}
+	defer func() {
+		for i := BucketCount - 1; i >= 0; i-- {
+			c.buckets[i].lock.Unlock()
+		}
+	}()
+
+	var v uint32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreUint32(&c.hashTags, v)
+	var ws []*watcher
+	for i := 0; i < BucketCount; i++ {
+		ws = append(ws, c.buckets[i].setHashTags(enabled)...)
+	}
+	for _, w := range ws {
+		keyHash := hashKey(w.key, enabled)
+		c.buckets[keyHash%BucketCount].watch(w, keyHash)
+	}
+}
+
+// DelGroup deletes all entries with the given hash tag, and returns the count of deleted entries.
+// Only the bucket of the tag is scanned if hash tags enabled, otherwise all buckets.
+func (c *Cache) DelGroup(tag []byte) int {
+	if len(tag) == 0 {
+		return 0
+	}
+	if c.hashTagsEnabled() {
+		return c.buckets[xxhash.Sum64(tag)%BucketCount].DelGroup(tag)
+	}
+	n := 0
+	for i := 0; i < BucketCount; i++ {
+		n += c.buckets[i].DelGroup(tag)
+	}
+	return n
+}
+
+// hash hashes the key for indexing.
+func (c *Cache) hash(key []byte) uint64 {
+	return hashKey(key, c.hashTagsEnabled())
+}
+
+func (c *Cache) hashTagsEnabled() bool { return atomic.LoadUint32(&c.hashTags) != 0 }
@@ -0,0 +1,105 @@
+package directcache
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_hashTag(t *testing.T) {
+	tests := []struct {
+		key string
+		tag string
+	}{
+		{"user:{42}:profile", "42"},
+		{"{42}", "42"},
+		{"{a}{b}", "a"},
+		{"{}x", ""},
+		{"{{a}}", "{a"},
+		{"x{", ""},
+		{"x}{", ""},
+		{"plain", ""},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.tag, string(hashTag([]byte(tt.key))), tt.key)
+	}
+
+	key := []byte("user:{42}:profile")
+	require.Equal(t, xxhash.Sum64(key), hashKey(key, false))
+	h := hashKey(key, true)
+	require.Equal(t, xxhash.Sum64([]byte("42"))%BucketCount, h%BucketCount)
+	require.Equal(t, xxhash.Sum64(key)>>8, h>>8)
+}
+
+func TestCacheHashTags(t *testing.T) {
+	c := New(0)
+	c.Set([]byte("k"), []byte("v"))
+	c.SetHashTags(true)
+	require.Zero(t, c.Len(), "cleared")
+
+	// grouped keys in the same bucket survive evictions and compaction
+	for i := 0; i < 1000; i++ {
+		c.Set([]byte(fmt.Sprintf("user:{%d}:profile", i%10)), make([]byte, i%50))
+		c.Set([]byte(fmt.Sprintf("user:{%d}:prefs", i%10)), make([]byte, i%30))
+		c.Set([]byte(fmt.Sprintf("post:%d", i)), make([]byte, 100))
+	}
+	c.Compact()
+	for i := 0; i < 10; i++ {
+		bkt := xxhash.Sum64([]byte(fmt.Sprint(i))) % BucketCount
+		for _, k := range []string{"user:{%d}:profile", "user:{%d}:prefs"} {
+			key := []byte(fmt.Sprintf(k, i))
+			_, found := c.buckets[bkt].lookup(key, c.hash(key))
+			require.True(t, found, string(key))
+		}
+	}
+	c.Dump(func(e Entry) bool {
+		require.True(t, c.Has(e.Key()), string(e.Key()))
+		return true
+	})
+
+	require.Equal(t, 2, c.DelGroup([]byte("3")))
+	require.False(t, c.Has([]byte("user:{3}:profile")))
+	require.True(t, c.Has([]byte("user:{4}:profile")))
+	require.Zero(t, c.DelGroup([]byte("3")))
+
+	// all buckets scanned without hash tags
+	c.SetHashTags(false)
+	for i := 0; i < 100; i++ {
+		c.Set([]byte(fmt.Sprintf("k%d:{g}", i)), []byte("v"))
+	}
+	require.Equal(t, 100, c.DelGroup([]byte("g")))
+	require.Zero(t, c.Len())
+}
+
+func TestCacheHashTagsWatch(t *testing.T) {
+	c := New(0)
+	key := []byte("user:{42}:profile")
+	require.NotEqual(t, hashKey(key, false)%BucketCount, hashKey(key, true)%BucketCount)
+	c.Set(key, []byte("v"))
+	events, cancel := c.Watch(key)
+	next := func() Event {
+		select {
+		case ev := <-events:
+			return ev
+		default:
+			return Event{Type: -1}
+		}
+	}
+
+	// the watcher is moved to the new bucket of the key
+	c.SetHashTags(true)
+	require.Equal(t, Event{EventDelete, key}, next())
+	c.Set(key, []byte("v"))
+	require.Equal(t, Event{EventSet, key}, next())
+
+	c.SetHashTags(false)
+	require.Equal(t, Event{EventDelete, key}, next())
+	cancel()
+	_, ok := <-events
+	require.False(t, ok, "closed")
+	for i := range c.buckets {
+		require.Empty(t, c.buckets[i].watchers)
+	}
+}
@@ -0,0 +1,46 @@
+package directcache
+
+// markChunk is the size of queue buffer chunks, each has at most one mark.
+const markChunk = 4096
+
+// marks remembers an entry offset in each chunk of the queue buffer, to locate
+// the entry at any offset without scanning the queue from the front.
+type marks struct {
+	offsets []int // the last offset pushed in each chunk, negative for none
+	minSize int   // min size of marked entries, not greater than sizes of entries in the queue
+}
+
+// Reset resets marks for the buffer capacity, and forgets all offsets.
+func (m *marks) Reset(capacity int) {
+	m.offsets = make([]int, (capacity+markChunk-1)/markChunk)
+	for i := range m.offsets {
+		m.offsets[i] = -1
+	}
+	m.minSize = 0
+}
+
+// Mark marks the entry pushed at the offset, and unmarks stale offsets it covers.
+func (m *marks) Mark(offset, size int) {
+	c := offset / markChunk
+	m.offsets[c] = offset
+	for c++; c < len(m.offsets) && c*markChunk < offset+size; c++ {
+		if m.offsets[c] < offset+size {
+			m.offsets[c] = -1
+		}
+	}
+	if m.minSize == 0 || size < m.minSize {
+		m.minSize = size
+	}
+}
+
+// Before returns a marked offset between from and offset, or from if none.
+// from must be an entry offset, and all bytes from it to offset in use, so that
+// offsets found are not stale.
+func (m *marks) Before(from, offset int) int {
+	for c := offset / markChunk; c >= from/markChunk; c-- {
+		if o := m.offsets[c]; o >= from && o <= offset {
+			return o
+		}
+	}
+	return from
+}
@@ -0,0 +1,33 @@
+package directcache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_marks(t *testing.T) {
+	var m marks
+	m.Reset(markChunk*3 + 1)
+	require.Len(t, m.offsets, 4)
+	require.Equal(t, 10, m.Before(10, markChunk*2), "none marked")
+
+	m.Mark(100, 200)
+	m.Mark(300, markChunk*2)
+	require.Equal(t, 200, m.minSize)
+	require.Equal(t, 300, m.Before(0, markChunk*2+1))
+	require.Equal(t, 300, m.Before(100, markChunk-1))
+	require.Equal(t, 100, m.Before(100, 299), "the mark of chunk 0 is after the offset")
+
+	// overwrite the second entry after it's popped
+	m.Mark(markChunk*2+300, 100)
+	m.Mark(200, markChunk*2+200)
+	require.Equal(t, -1, m.offsets[2], "stale mark dropped")
+	require.Equal(t, 200, m.Before(100, markChunk*2+300))
+	require.Equal(t, 100, m.minSize)
+
+	m.Reset(markChunk)
+	require.Len(t, m.offsets, 1)
+	require.Zero(t, m.minSize)
+	require.Equal(t, 0, m.Before(0, 100))
+}
@@ -0,0 +1,31 @@
+package directcache
+
+// SetMissingLimit sets the max bytes of negative entries. Non-positive limit restores the default.
+func (b *bucket) SetMissingLimit(limit int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if limit < 0 {
+		limit = 0
+	}
+	b.missLimit = limit
+}
+
+// maxMissing returns the max bytes of negative entries, which is 1/8 of the capacity by default.
+func (b *bucket) maxMissing() int {
+	if b.missLimit > 0 {
+		return b.missLimit
+	}
+	return b.q.Cap() / 8
+}
+
+// missingFits returns true if a negative entry of the given size can be set for the key
+// without exceeding the limit of negative bytes. The old negative entry of the key is replaced.
+func (b *bucket) missingFits(keyParts [][]byte, keyHash uint64, size int) bool {
+	missing := b.missing + size
+	if offset, found := b.m.Get(keyHash); found {
+		if ent := b.entryAt(offset); ent.Missing() && partsEqual(keyParts, ent.Key()) {
+			missing -= ent.Size()
+		}
+	}
+	return missing <= b.maxMissing()
+}
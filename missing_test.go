@@ -0,0 +1,70 @@
+package directcache
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_bucketMissingLimit(t *testing.T) {
+	var bkt bucket
+	size := entrySizeExt(8, 0, 0, missingExt)
+	bkt.Reset(size * 16)
+
+	keyOf := func(i int) []byte {
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], uint64(i))
+		return key[:]
+	}
+	set := func(i int) bool { k := keyOf(i); return bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {}) }
+	setMissing := func(i int) bool {
+		k := keyOf(i)
+		return bkt.SetExt(k, xxhash.Sum64(k), 0, &ext{flags: missingExt}, func(val []byte) {})
+	}
+	has := func(i int) bool {
+		k := keyOf(i)
+		return bkt.GetExt(k, xxhash.Sum64(k), func(entry) {}, true)
+	}
+
+	for i := 0; i < 12; i++ {
+		require.True(t, set(i))
+	}
+	// default limit is 1/8 of the capacity
+	require.True(t, setMissing(100))
+	require.True(t, setMissing(101))
+	require.Equal(t, size*2, bkt.Stats().MissingBytes)
+	require.False(t, setMissing(102), "missing limit exceeded")
+	require.True(t, setMissing(101), "replacing the negative entry")
+
+	// the flood of negative entries never pushes out real entries
+	for i := 200; i < 1000; i++ {
+		setMissing(i)
+	}
+	for i := 0; i < 12; i++ {
+		require.True(t, has(i))
+	}
+	require.Equal(t, size*2, bkt.Stats().MissingBytes)
+
+	// overwritten by a real entry
+	require.True(t, set(100))
+	require.Equal(t, size, bkt.Stats().MissingBytes)
+	k := keyOf(101)
+	require.True(t, bkt.Del(k, xxhash.Sum64(k)))
+	require.Zero(t, bkt.Stats().MissingBytes)
+
+	bkt.SetMissingLimit(size * 4)
+	for i := 0; i < 4; i++ {
+		require.True(t, setMissing(300+i))
+	}
+	require.False(t, setMissing(304))
+	bkt.SetMissingLimit(-1)
+	require.False(t, setMissing(304), "default limit restored")
+
+	// evicted negative entries are not counted
+	for i := 1000; i < 1100; i++ {
+		require.True(t, set(i))
+	}
+	require.Zero(t, bkt.Stats().MissingBytes)
+}
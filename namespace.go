@@ -0,0 +1,110 @@
+package directcache
+
+// namespaces tracks per-namespace usage of a bucket.
+// Keys are mapped to namespaces by the classify func.
+type namespaces struct {
+	classify func(key []byte) int
+	quotas   []int // quota in bytes of each namespace, non-positive means no limit
+	usages   []int // bytes of entries of each namespace
+}
+
+// Reset resets the classifier and quotas, and clears usages.
+func (n *namespaces) Reset(classify func(key []byte) int, quotas []int) {
+	if classify == nil {
+		*n = namespaces{}
+		return
+	}
+	n.classify = classify
+	n.quotas = append([]int(nil), quotas...)
+	n.usages = make([]int, len(quotas))
+}
+
+// Clear clears usages.
+func (n *namespaces) Clear() {
+	for i := range n.usages {
+		n.usages[i] = 0
+	}
+}
+
+// Enabled returns whether the classifier is set.
+func (n *namespaces) Enabled() bool { return n.classify != nil }
+
+// of returns the namespace of the key, or -1 if not classified.
+func (n *namespaces) of(key []byte) int {
+	if n.classify == nil {
+		return -1
+	}
+	if ns := n.classify(key); ns >= 0 && ns < len(n.usages) {
+		return ns
+	}
+	return -1
+}
+
+// Add adds delta bytes to the usage of the key's namespace.
+func (n *namespaces) Add(key []byte, delta int) {
+	if ns := n.of(key); ns >= 0 {
+		n.usages[ns] += delta
+	}
+}
+
+// Usage returns the usage of the namespace.
+func (n *namespaces) Usage(ns int) int {
+	if ns >= 0 && ns < len(n.usages) {
+		return n.usages[ns]
+	}
+	return 0
+}
+
+// Over returns whether the key's namespace is over quota.
+func (n *namespaces) Over(key []byte) bool {
+	if ns := n.of(key); ns >= 0 {
+		return n.over(ns)
+	}
+	return false
+}
+
+// AnyOver returns whether any namespace is over quota.
+func (n *namespaces) AnyOver() bool {
+	for i := range n.usages {
+		if n.over(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fits returns whether the entry of the given size fits in the quota of the key's namespace.
+func (n *namespaces) Fits(key []byte, size int) bool {
+	if ns := n.of(key); ns >= 0 && n.quotas[ns] > 0 {
+		return size <= n.quotas[ns]
+	}
+	return true
+}
+
+func (n *namespaces) over(ns int) bool {
+	return n.quotas[ns] > 0 && n.usages[ns] > n.quotas[ns]
+}
+
+// fitQuota evicts the oldest entries of the key's namespace, until the new entry of the given
+// size fits in the quota. Pinned entries are kept, so the quota may still be exceeded.
+// It returns the namespace if it's at quota, or -1 otherwise.
+func (b *bucket) fitQuota(key []byte, size int) int {
+	ns := b.ns.of(key)
+	if ns < 0 || b.ns.quotas[ns] <= 0 || b.ns.usages[ns]+size <= b.ns.quotas[ns] {
+		return -1
+	}
+	b.each(func(ent entry) bool {
+		if b.ns.usages[ns]+size <= b.ns.quotas[ns] {
+			return false
+		}
+		if !ent.HasFlag(pinnedFlag) && b.ns.of(ent.Key()) == ns {
+			keyHash := hashKey(ent.Key(), b.hashTags)
+			b.m.Del(keyHash)
+			b.forget(ent, keyHash)
+			b.markDeleted(ent)
+			b.notify(EventEvicted, ent.Key(), keyHash)
+		}
+		return true
+	})
+	return ns
+}
@@ -0,0 +1,34 @@
+package directcache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_namespaces(t *testing.T) {
+	var n namespaces
+	require.False(t, n.Enabled())
+	n.Add([]byte("a"), 10) // no-op
+	require.Zero(t, n.Usage(0))
+
+	n.Reset(func(key []byte) int { return int(key[0] - 'a') }, []int{10, 0})
+	require.True(t, n.Enabled())
+
+	n.Add([]byte("a"), 10)
+	n.Add([]byte("b"), 100)
+	n.Add([]byte("z"), 100) // out of range
+	require.Equal(t, 10, n.Usage(0))
+	require.Equal(t, 100, n.Usage(1))
+	require.False(t, n.Over([]byte("a")))
+	require.False(t, n.Over([]byte("b")), "no limit")
+	require.False(t, n.AnyOver())
+
+	n.Add([]byte("a"), 1)
+	require.True(t, n.Over([]byte("a")))
+	require.True(t, n.AnyOver())
+
+	n.Clear()
+	require.Zero(t, n.Usage(0))
+	require.Zero(t, n.Usage(1))
+}
@@ -0,0 +1,8 @@
+//go:build !directcache_debug
+// +build !directcache_debug
+
+package directcache
+
+// debug enables expensive sanity checks, e.g. hashes passed to GetHashed.
+// Build with tag directcache_debug to enable it.
+const debug = false
@@ -0,0 +1,74 @@
+package directcache
+
+import "bytes"
+
+// Pin increases the pin count of the key.
+// false is returned if the key does not exist or the pin limit exceeded.
+func (b *bucket) Pin(key []byte, keyHash uint64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if offset, found := b.m.Get(keyHash); found {
+		if ent := b.entryAt(offset); bytes.Equal(ent.Key(), key) {
+			if !ent.HasFlag(pinnedFlag) {
+				if b.pinned+ent.Size() > b.maxPinned() {
+					return false
+				}
+				b.pin(ent)
+			}
+			if b.pins == nil {
+				b.pins = make(map[uint64]int)
+			}
+			b.pins[keyHash]++
+			return true
+		}
+	}
+	return false
+}
+
+// Unpin decreases the pin count of the key, and unpins the entry if the count drops to 0.
+// false is returned if the key is not pinned.
+func (b *bucket) Unpin(key []byte, keyHash uint64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if offset, found := b.m.Get(keyHash); found {
+		if ent := b.entryAt(offset); bytes.Equal(ent.Key(), key) && ent.HasFlag(pinnedFlag) {
+			if b.pins[keyHash]--; b.pins[keyHash] <= 0 {
+				delete(b.pins, keyHash)
+				ent.RemoveFlag(pinnedFlag)
+				b.pinned -= ent.Size()
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// SetPinLimit sets the max bytes of pinned entries. Non-positive limit restores the default.
+func (b *bucket) SetPinLimit(limit int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if limit < 0 {
+		limit = 0
+	}
+	b.pinLimit = limit
+}
+
+// maxPinned returns the max bytes of pinned entries, which is half of the capacity by default.
+func (b *bucket) maxPinned() int {
+	if b.pinLimit > 0 {
+		return b.pinLimit
+	}
+	return b.q.Cap() / 2
+}
+
+// repinFits returns true if the pinned entry can be replaced by a new entry of the
+// given size, which is pinned as well, without exceeding the pin limit.
+func (b *bucket) repinFits(old entry, size int) bool {
+	return b.pinned-old.Size()+size <= b.maxPinned()
+}
+
+// pin flags the entry pinned.
+func (b *bucket) pin(ent entry) {
+	ent.AddFlag(pinnedFlag)
+	b.pinned += ent.Size()
+}
@@ -0,0 +1,171 @@
+package directcache
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_bucketPin(t *testing.T) {
+	var bkt bucket
+	size := entrySize(8, 8, 0)
+	bkt.Reset(size * 10)
+
+	keyOf := func(i int) []byte {
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], uint64(i))
+		return key[:]
+	}
+	set := func(i int) bool { k := keyOf(i); return bkt.Set(k, xxhash.Sum64(k), 8, func(val []byte) {}) }
+	has := func(i int) bool {
+		k := keyOf(i)
+		return bkt.Get(k, xxhash.Sum64(k), func(val []byte) {}, true)
+	}
+	pin := func(i int) bool { k := keyOf(i); return bkt.Pin(k, xxhash.Sum64(k)) }
+	unpin := func(i int) bool { k := keyOf(i); return bkt.Unpin(k, xxhash.Sum64(k)) }
+
+	for i := 0; i < 5; i++ {
+		require.True(t, set(i))
+	}
+	require.False(t, pin(100), "pin missing key")
+	require.False(t, unpin(0), "unpin unpinned key")
+
+	require.True(t, pin(0))
+	require.True(t, pin(0))
+	require.True(t, pin(3))
+	require.Equal(t, size*2, bkt.Stats().PinnedBytes)
+
+	// default limit is half of the capacity
+	require.True(t, pin(1))
+	require.True(t, pin(2))
+	require.True(t, pin(4))
+	require.Equal(t, size*5, bkt.Stats().PinnedBytes)
+	require.True(t, set(5))
+	require.False(t, pin(5), "pin limit exceeded")
+	for i := 1; i < 5; i++ {
+		require.True(t, unpin(i))
+	}
+	require.Equal(t, size, bkt.Stats().PinnedBytes)
+
+	// pinned entry survives massive insertions
+	for i := 10; i < 1000; i++ {
+		require.True(t, set(i))
+	}
+	require.True(t, has(0))
+	require.False(t, has(1))
+
+	// overwriting keeps it pinned
+	bkt.Set(keyOf(0), xxhash.Sum64(keyOf(0)), 16, func(val []byte) {})
+	require.Equal(t, entrySize(8, 16, 0), bkt.Stats().PinnedBytes)
+	for i := 1000; i < 2000; i++ {
+		require.True(t, set(i))
+	}
+	require.True(t, has(0))
+
+	// pinned twice, so unpinned after 2 calls
+	require.True(t, unpin(0))
+	require.True(t, unpin(0))
+	require.False(t, unpin(0))
+	require.Zero(t, bkt.Stats().PinnedBytes)
+	for i := 2000; i < 3000; i++ {
+		require.True(t, set(i))
+	}
+	require.False(t, has(0))
+
+	// deleting clears the pin
+	require.True(t, pin(2999))
+	k := keyOf(2999)
+	require.True(t, bkt.Del(k, xxhash.Sum64(k)))
+	require.Zero(t, bkt.Stats().PinnedBytes)
+	require.True(t, set(2999))
+	require.False(t, unpin(2999))
+}
+
+func Test_bucketPinLimit(t *testing.T) {
+	var bkt bucket
+	size := entrySize(8, 8, 0)
+	bkt.Reset(size * 10)
+	bkt.SetPinLimit(size * 9)
+
+	keyOf := func(i int) []byte {
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], uint64(i))
+		return key[:]
+	}
+	for i := 0; i < 9; i++ {
+		k := keyOf(i)
+		require.True(t, bkt.Set(k, xxhash.Sum64(k), 8, func(val []byte) {}))
+		require.True(t, bkt.Pin(k, xxhash.Sum64(k)))
+	}
+
+	// not enough space excluding pinned entries
+	k := keyOf(100)
+	require.False(t, bkt.Set(k, xxhash.Sum64(k), 16, func(val []byte) {}))
+	for i := 100; i < 200; i++ {
+		k := keyOf(i)
+		require.True(t, bkt.Set(k, xxhash.Sum64(k), 8, func(val []byte) {}))
+	}
+	require.Equal(t, 10, bkt.Stats().Len)
+
+	// non-positive limit restores the default, which is half of the capacity
+	bkt.SetPinLimit(0)
+	bkt.Reset(size * 10)
+	require.Zero(t, bkt.Stats().PinnedBytes)
+	for i := 0; i < 6; i++ {
+		k := keyOf(i)
+		require.True(t, bkt.Set(k, xxhash.Sum64(k), 8, func(val []byte) {}))
+		require.Equal(t, i < 5, bkt.Pin(k, xxhash.Sum64(k)))
+	}
+
+	// overwriting pinned entries re-pins them within the limit
+	require.True(t, bkt.Unpin(keyOf(4), xxhash.Sum64(keyOf(4))))
+	k = keyOf(0)
+	require.True(t, bkt.Set(k, xxhash.Sum64(k), 9, func(val []byte) {}))
+	pinned := size*3 + entrySize(8, 9, 0)
+	require.Equal(t, pinned, bkt.Stats().PinnedBytes)
+	require.False(t, bkt.Set(k, xxhash.Sum64(k), 9+size, func(val []byte) {}), "pin limit exceeded")
+	ok, err := bkt.SetE(k, xxhash.Sum64(k), 9+size, func(val []byte) error { return nil })
+	require.False(t, ok, "pin limit exceeded")
+	require.NoError(t, err)
+	require.True(t, bkt.Get(k, xxhash.Sum64(k), func(val []byte) {
+		require.Len(t, val, 9, "old entry kept")
+	}, true))
+	require.Equal(t, pinned, bkt.Stats().PinnedBytes)
+	require.True(t, bkt.Set(k, xxhash.Sum64(k), 8+size, func(val []byte) {}), "up to the limit")
+	require.Equal(t, bkt.maxPinned(), bkt.Stats().PinnedBytes)
+}
+
+func Test_bucketDisplace(t *testing.T) {
+	var bkt bucket
+	bkt.Reset(1000)
+
+	a := []byte("a")
+	ah := xxhash.Sum64(a)
+	// another key sharing the index slot
+	b := []byte("b")
+	bh := ah ^ 1
+
+	for _, set := range []func() bool{
+		func() bool { return bkt.Set(b, bh, 1, func(val []byte) {}) },
+		func() bool { ok, _ := bkt.SetE(b, bh, 1, func(val []byte) error { return nil }); return ok },
+	} {
+		require.True(t, bkt.Set(a, ah, 1, func(val []byte) {}))
+		require.True(t, bkt.Pin(a, ah))
+		require.True(t, bkt.Pin(a, ah))
+		w := bkt.Watch(a, ah)
+
+		require.True(t, set())
+		require.Empty(t, bkt.pins, "pin count of the displaced key dropped")
+		require.Zero(t, bkt.Stats().PinnedBytes)
+		require.Equal(t, EventEvicted, (<-w.ch).Type)
+		bkt.Unwatch(w, ah)
+
+		// pinned again from scratch
+		require.True(t, bkt.Set(a, ah, 1, func(val []byte) {}))
+		require.True(t, bkt.Pin(a, ah))
+		require.True(t, bkt.Unpin(a, ah))
+		require.Zero(t, bkt.Stats().PinnedBytes)
+	}
+}
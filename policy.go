@@ -0,0 +1,132 @@
+package directcache
+
+// Policy is the built-in eviction policy.
+type Policy int
+
+const (
+	// PolicyLRU is the default policy. Entries recently used get a second chance
+	// when reaching the front of the queue.
+	PolicyLRU Policy = iota
+	// PolicyS3FIFO is the S3-FIFO policy. New entries are probationary, and evicted
+	// at the front of the queue unless accessed, which promotes them to the main queue.
+	// Entries of the main queue are kept as long as the access frequency remains.
+	// Keys of evicted probationary entries are remembered by a ghost set, and re-inserted
+	// directly into the main queue.
+	//
+	// Since all entries share the same FIFO queue, the small and main queue are
+	// distinguished by a flag of the entry.
+	PolicyS3FIFO
+	// PolicyClockPro is the CLOCK-Pro policy. New entries are cold and promoted to hot
+	// if accessed before reaching the front of the queue. Evicted cold entries are
+	// remembered by a ghost set, and re-inserted as hot. Unreferenced hot entries are
+	// demoted to cold when hot entries exceed the adaptive target.
+	PolicyClockPro
+	// PolicyGDSF is the GreedyDual-Size-Frequency policy. The priority of an entry is
+	// its cost (see SetWithCost) multiplied by the access frequency, divided by its size.
+	// Entries with priority below the running average are evicted, and the frequency
+	// decays when an entry is kept, so that the priority ages over time.
+	PolicyGDSF
+)
+
+// defaultPushLimit is the default max count of entries pushed back for an insertion.
+const defaultPushLimit = 8
+
+// EvictionContext describes the bucket state when an eviction decision is made.
+type EvictionContext struct {
+	Bucket      int // index of the bucket
+	BytesNeeded int // bytes needed by the entry being inserted
+	BytesFree   int // free bytes of the bucket, which may be not contiguous
+	RetriesLeft int // count of entries can still be pushed back, before entries are evicted regardless of the policy
+}
+
+// builtinEvict applies the built-in policy to the popped entry, and returns whether
+// to evict it.
+func (b *bucket) builtinEvict(ent entry) bool {
+	switch b.policy {
+	case PolicyS3FIFO:
+		if ent.HasFlag(hotFlag) {
+			// main queue, evicted if not accessed since last pass
+			return ent.Frequency() == 0
+		}
+		// small queue, promoted if accessed since inserted
+		if ent.Frequency() == 0 {
+			return true
+		}
+		b.promote(ent)
+		return false
+	case PolicyClockPro:
+		referenced := ent.HasFlag(recentlyUsedFlag)
+		if ent.HasFlag(hotFlag) {
+			if !referenced && b.hot > b.q.Cap()-b.coldTarget {
+				b.demote(ent)
+			}
+			return false
+		}
+		if referenced {
+			b.promote(ent)
+			return false
+		}
+		// not reused in the test period, shrink cold space
+		b.adjustColdTarget(-len(ent))
+		return true
+	case PolicyGDSF:
+		priority := float64(ent.Cost()) * float64(ent.Frequency()+1) / float64(len(ent))
+		evict := priority <= b.avgPriority
+		b.avgPriority += (priority - b.avgPriority) / 16
+		return evict
+	default:
+		return !ent.HasFlag(recentlyUsedFlag)
+	}
+}
+
+// admitHot tests whether the new entry of the key hash should be inserted as hot,
+// i.e. the key was evicted recently.
+func (b *bucket) admitHot(keyHash uint64, entrySize int) bool {
+	if !b.usesGhost() {
+		return false
+	}
+	if b.count > b.ghost.Len() {
+		b.ghost.Reset(b.count * 2)
+	}
+	if !b.ghost.Take(keyHash) {
+		return false
+	}
+	if b.policy == PolicyClockPro {
+		// reused in the test period, enlarge cold space
+		b.adjustColdTarget(entrySize)
+	}
+	return true
+}
+
+// forget remembers the evicted entry in ghost if it's not hot.
+func (b *bucket) forget(ent entry, keyHash uint64) {
+	if b.usesGhost() && !ent.HasFlag(hotFlag) {
+		b.ghost.Add(keyHash)
+	}
+}
+
+// usesGhost returns whether the built-in policy in effect uses ghost.
+func (b *bucket) usesGhost() bool {
+	return b.shouldEvict == nil && (b.policy == PolicyS3FIFO || b.policy == PolicyClockPro)
+}
+
+func (b *bucket) promote(ent entry) {
+	ent.AddFlag(hotFlag)
+	b.hot += ent.Size()
+}
+
+func (b *bucket) demote(ent entry) {
+	ent.RemoveFlag(hotFlag)
+	b.hot -= ent.Size()
+}
+
+// adjustColdTarget adjusts the target size of cold entries of CLOCK-Pro.
+func (b *bucket) adjustColdTarget(delta int) {
+	min, max := b.q.Cap()/16, b.q.Cap()-b.q.Cap()/16
+	b.coldTarget += delta
+	if b.coldTarget < min {
+		b.coldTarget = min
+	} else if b.coldTarget > max {
+		b.coldTarget = max
+	}
+}
@@ -0,0 +1,99 @@
+package directcache
+
+import (
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_bucketBuiltinPolicy(t *testing.T) {
+	const n = 10
+	for _, policy := range []Policy{PolicyS3FIFO, PolicyClockPro} {
+		var bkt bucket
+		bkt.Reset(entrySize(2, 0, 0) * n)
+		bkt.SetPolicy(policy)
+
+		set := func(k []byte) { bkt.Set(k, xxhash.Sum64(k), 0, func(val []byte) {}) }
+		has := func(k []byte) bool { return bkt.Get(k, xxhash.Sum64(k), nil, true) }
+		isHot := func(k []byte) (hot bool) {
+			bkt.Dump(func(e Entry) bool {
+				if string(e.Key()) == string(k) {
+					hot = e.(entry).HasFlag(hotFlag)
+				}
+				return true
+			})
+			return
+		}
+		hotBytes := func() (n int) {
+			bkt.Dump(func(e Entry) bool {
+				if e.(entry).HasFlag(hotFlag) {
+					n += e.(entry).Size()
+				}
+				return true
+			})
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			set([]byte{'a', byte(i)})
+		}
+		// access half of them
+		for i := 0; i < n/2; i++ {
+			k := []byte{'a', byte(i)}
+			bkt.Get(k, xxhash.Sum64(k), nil, false)
+		}
+		// a few new entries evict not accessed ones, and accessed ones get promoted
+		for i := 0; i < n/2; i++ {
+			set([]byte{'b', byte(i)})
+		}
+		for i := 0; i < n; i++ {
+			k := []byte{'a', byte(i)}
+			require.Equal(t, i < n/2, has(k), "policy %v key %v", policy, k)
+			require.Equal(t, i < n/2, isHot(k), "policy %v key %v", policy, k)
+		}
+		require.Equal(t, entrySize(2, 0, 0)*n/2, bkt.hot)
+
+		// evicted keys are remembered and inserted as hot
+		k := []byte{'a', n - 1}
+		set(k)
+		require.True(t, isHot(k))
+		require.Equal(t, hotBytes(), bkt.hot)
+
+		// overwrite keeps hot
+		bkt.Set(k, xxhash.Sum64(k), 1, func(val []byte) {})
+		require.True(t, isHot(k))
+		require.Equal(t, hotBytes(), bkt.hot)
+		bkt.Del(k, xxhash.Sum64(k))
+		require.False(t, has(k))
+		require.Equal(t, hotBytes(), bkt.hot)
+
+		// hot bytes recounted
+		hot := bkt.hot
+		bkt.SetPolicy(policy)
+		require.Equal(t, hot, bkt.hot)
+	}
+}
+
+func Test_bucketGDSF(t *testing.T) {
+	const n = 10
+	var bkt bucket
+	bkt.Reset(entrySizeExt(2, 0, 0, costExt) * n)
+	bkt.SetPolicy(PolicyGDSF)
+
+	set := func(k []byte, cost uint32) {
+		bkt.SetExt(k, xxhash.Sum64(k), 0, &ext{flags: costExt, cost: cost}, func(val []byte) {})
+	}
+	has := func(k []byte) bool { return bkt.Get(k, xxhash.Sum64(k), nil, true) }
+
+	// expensive and cheap entries interleaved
+	for i := 0; i < n; i++ {
+		set([]byte{'a', byte(i)}, uint32(1+i%2*1000))
+	}
+	for i := 0; i < n*10; i++ {
+		set([]byte{'b', byte(i)}, 1)
+	}
+	for i := 0; i < n; i++ {
+		require.Equal(t, i%2 == 1, has([]byte{'a', byte(i)}), "expensive entries should be kept")
+	}
+}
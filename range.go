@@ -0,0 +1,90 @@
+package directcache
+
+import "math/bits"
+
+// Update modifies the value for key in place. The entry is considered written
+// if fn returns true. false is returned if the key not found or fn returns false.
+func (b *bucket) Update(key []byte, keyHash uint64, fn func(val []byte) bool) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ent, found := b.lookup(key, keyHash); found && ent.readable() && fn(ent.Value()) {
+		b.stamp(ent)
+		ent.AddFlag(recentlyUsedFlag)
+		b.notify(EventUpdate, ent.Key(), keyHash)
+		return true
+	}
+	return false
+}
+
+// GetRange appends at most n bytes of the value starting at off to dst, and returns
+// the extended buffer. It returns false if no entry matching the given key.
+func (c *Cache) GetRange(key []byte, off, n int, dst []byte) ([]byte, bool) {
+	ok := c.AdvGet(key, func(val []byte) {
+		if off >= 0 && off < len(val) && n > 0 {
+			if val = val[off:]; n < len(val) {
+				val = val[:n]
+			}
+			dst = append(dst, val...)
+		}
+	}, false)
+	return dst, ok
+}
+
+// SetRange overwrites the value of the entry matching the given key with data starting
+// at off, in place. The value never grows, so it returns false if the range exceeds the
+// value, or no matched entry.
+//
+// It's safe to modify contents of key and data after SetRange returns.
+func (c *Cache) SetRange(key []byte, off int, data []byte) bool {
+	keyHash := c.hash(key)
+	return c.buckets[keyHash%BucketCount].Update(key, keyHash, func(val []byte) bool {
+		if off < 0 || off+len(data) > len(val) {
+			return false
+		}
+		copy(val[off:], data)
+		return true
+	})
+}
+
+// SetBit sets the bit at offset of the value of the entry matching the given key to v,
+// and returns the old bit. Bits are counted from the most significant bit of the first
+// byte. It returns false if the offset exceeds the value, or no matched entry.
+func (c *Cache) SetBit(key []byte, offset int, v bool) (old bool, ok bool) {
+	keyHash := c.hash(key)
+	ok = c.buckets[keyHash%BucketCount].Update(key, keyHash, func(val []byte) bool {
+		if offset < 0 || offset >= len(val)*8 {
+			return false
+		}
+		mask := byte(0x80) >> uint(offset%8)
+		old = val[offset/8]&mask != 0
+		if v {
+			val[offset/8] |= mask
+		} else {
+			val[offset/8] &^= mask
+		}
+		return true
+	})
+	return
+}
+
+// GetBit returns the bit at offset of the value of the entry matching the given key.
+// Bits out of the value are 0. It returns false if no matched entry.
+func (c *Cache) GetBit(key []byte, offset int) (bit bool, ok bool) {
+	ok = c.AdvGet(key, func(val []byte) {
+		if offset >= 0 && offset < len(val)*8 {
+			bit = val[offset/8]&(byte(0x80)>>uint(offset%8)) != 0
+		}
+	}, false)
+	return
+}
+
+// BitCount returns the count of set bits of the value of the entry matching the given key.
+// It returns false if no matched entry.
+func (c *Cache) BitCount(key []byte) (n int, ok bool) {
+	ok = c.AdvGet(key, func(val []byte) {
+		for _, b := range val {
+			n += bits.OnesCount8(b)
+		}
+	}, false)
+	return
+}
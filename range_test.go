@@ -0,0 +1,89 @@
+package directcache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_bucketUpdate(t *testing.T) {
+	var bkt bucket
+	bkt.Reset(1000)
+	k := []byte("k")
+	kh := hashKey(k, false)
+
+	require.False(t, bkt.Update(k, kh, func(val []byte) bool { panic("should not be called") }))
+	bkt.Set(k, kh, 2, func(val []byte) { copy(val, "ab") })
+	v1, _ := bkt.GetWithVersion(k, kh, nil, true)
+	used := bkt.Stats().UsedBytes
+
+	require.False(t, bkt.Update(k, kh, func(val []byte) bool { return false }))
+	v2, _ := bkt.GetWithVersion(k, kh, nil, true)
+	require.Equal(t, v1, v2, "not written")
+
+	require.True(t, bkt.Update(k, kh, func(val []byte) bool { val[1] = 'c'; return true }))
+	v3, _ := bkt.GetWithVersion(k, kh, func(val []byte) { require.Equal(t, []byte("ac"), val) }, true)
+	require.Greater(t, v3, v2)
+	require.Equal(t, used, bkt.Stats().UsedBytes)
+	require.Zero(t, bkt.Stats().DeadBytes, "no reinsert")
+}
+
+func TestCacheRange(t *testing.T) {
+	c := New(0)
+	k := []byte("blob")
+	_, ok := c.GetRange(k, 0, 1, nil)
+	require.False(t, ok)
+	require.False(t, c.SetRange(k, 0, []byte("x")))
+
+	c.Set(k, []byte("0123456789"))
+	dst, ok := c.GetRange(k, 2, 3, []byte("prefix:"))
+	require.True(t, ok)
+	require.Equal(t, []byte("prefix:234"), dst)
+	dst, _ = c.GetRange(k, 8, 100, nil)
+	require.Equal(t, []byte("89"), dst)
+	dst, ok = c.GetRange(k, 10, 1, nil)
+	require.True(t, ok)
+	require.Empty(t, dst)
+
+	require.True(t, c.SetRange(k, 8, []byte("ab")))
+	require.False(t, c.SetRange(k, 9, []byte("ab")), "never grows")
+	require.False(t, c.SetRange(k, -1, []byte("a")))
+	val, _ := c.Get(k)
+	require.Equal(t, []byte("01234567ab"), val)
+}
+
+func TestCacheBits(t *testing.T) {
+	c := New(0)
+	k := []byte("bitmap")
+	_, ok := c.SetBit(k, 0, true)
+	require.False(t, ok)
+
+	c.Set(k, make([]byte, 2))
+	old, ok := c.SetBit(k, 0, true)
+	require.True(t, ok)
+	require.False(t, old)
+	old, _ = c.SetBit(k, 0, true)
+	require.True(t, old)
+	c.SetBit(k, 9, true)
+	c.SetBit(k, 15, true)
+	_, ok = c.SetBit(k, 16, true)
+	require.False(t, ok)
+
+	val, _ := c.Get(k)
+	require.Equal(t, []byte{0x80, 0x41}, val)
+	n, _ := c.BitCount(k)
+	require.Equal(t, 3, n)
+
+	bit, _ := c.GetBit(k, 9)
+	require.True(t, bit)
+	bit, _ = c.GetBit(k, 10)
+	require.False(t, bit)
+	bit, ok = c.GetBit(k, 100)
+	require.True(t, ok)
+	require.False(t, bit)
+
+	old, _ = c.SetBit(k, 9, false)
+	require.True(t, old)
+	n, _ = c.BitCount(k)
+	require.Equal(t, 2, n)
+}
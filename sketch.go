@@ -0,0 +1,84 @@
+package directcache
+
+import "sync/atomic"
+
+const (
+	sketchDepth   = 4
+	sketchMaxFreq = 15
+)
+
+// sketchSeeds are odd multipliers to derive independent hashes of rows.
+var sketchSeeds = [sketchDepth]uint64{
+	0x9e3779b97f4a7c15,
+	0xc2b2ae3d27d4eb4f,
+	0x165667b19e3779f9,
+	0xd6e8feb86659fd93,
+}
+
+// sketch is the count-min sketch to estimate access frequencies of keys.
+// Counters are halved periodically, so that old accesses fade out.
+//
+// Add and Estimate are safe for concurrent use, while Age must be called exclusively.
+type sketch struct {
+	counters  []uint32
+	width     int
+	shift     uint   // 64 - log2(width)
+	additions uint32 // additions since last aging
+	period    uint32 // additions between two agings
+}
+
+// newSketch creates a sketch for about n keys.
+func newSketch(n int) *sketch {
+	width, shift := 16, uint(60)
+	for width < n {
+		width <<= 1
+		shift--
+	}
+	return &sketch{
+		counters: make([]uint32, width*sketchDepth),
+		width:    width,
+		shift:    shift,
+		period:   uint32(width * 10),
+	}
+}
+
+// index returns the index of counter in the i-th row for the key hash.
+func (s *sketch) index(keyHash uint64, i int) int {
+	return i*s.width + int((keyHash*sketchSeeds[i])>>s.shift)
+}
+
+// Add increases the frequency of the key hash.
+func (s *sketch) Add(keyHash uint64) {
+	for i := 0; i < sketchDepth; i++ {
+		p := &s.counters[s.index(keyHash, i)]
+		for {
+			n := atomic.LoadUint32(p)
+			if n >= sketchMaxFreq || atomic.CompareAndSwapUint32(p, n, n+1) {
+				break
+			}
+		}
+	}
+	atomic.AddUint32(&s.additions, 1)
+}
+
+// Estimate returns the estimated frequency of the key hash.
+func (s *sketch) Estimate(keyHash uint64) int {
+	min := uint32(sketchMaxFreq)
+	for i := 0; i < sketchDepth; i++ {
+		if n := atomic.LoadUint32(&s.counters[s.index(keyHash, i)]); n < min {
+			min = n
+		}
+	}
+	return int(min)
+}
+
+// Age halves all counters if enough additions happened since last aging.
+func (s *sketch) Age() {
+	if s.additions < s.period {
+		return
+	}
+	for i := range s.counters {
+		s.counters[i] >>= 1
+	}
+	s.additions = 0
+}
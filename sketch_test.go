@@ -0,0 +1,44 @@
+package directcache
+
+import (
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sketch(t *testing.T) {
+	var (
+		s = newSketch(100)
+		a = xxhash.Sum64String("a")
+		b = xxhash.Sum64String("b")
+		c = xxhash.Sum64String("c")
+	)
+	require.Equal(t, 128, s.width)
+
+	for i := 0; i < 10; i++ {
+		s.Add(a)
+	}
+	s.Add(b)
+	require.Equal(t, 10, s.Estimate(a))
+	require.Equal(t, 1, s.Estimate(b))
+	require.Zero(t, s.Estimate(c))
+
+	// saturated
+	for i := 0; i < 10; i++ {
+		s.Add(a)
+	}
+	require.Equal(t, sketchMaxFreq, s.Estimate(a))
+
+	// not aged before the period reached
+	s.Age()
+	require.Equal(t, sketchMaxFreq, s.Estimate(a))
+
+	for s.additions < s.period {
+		s.Add(c)
+	}
+	s.Age()
+	require.Equal(t, sketchMaxFreq/2, s.Estimate(a))
+	require.Zero(t, s.Estimate(b))
+	require.Zero(t, s.additions)
+}
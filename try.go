@@ -0,0 +1,49 @@
+package directcache
+
+import "sync/atomic"
+
+// TryGet is like Get, but fails fast if the lock is not available, and contended is true then.
+func (b *bucket) TryGet(key []byte, keyHash uint64, fn func(val []byte), peek bool) (ok, contended bool) {
+	if !b.lock.TryRLock() {
+		atomic.AddUint64(&b.contended, 1)
+		return false, true
+	}
+	defer b.lock.RUnlock()
+	return b.get(key, keyHash, fn, peek), false
+}
+
+// TrySet is like Set, but fails fast if the lock is not available, and contended is true then.
+func (b *bucket) TrySet(key []byte, keyHash uint64, valLen int, fn func(val []byte)) (ok, contended bool) {
+	if !b.lock.TryLock() {
+		atomic.AddUint64(&b.contended, 1)
+		return false, true
+	}
+	defer b.lock.Unlock()
+	return b.set([][]byte{key}, keyHash, valLen, nil, b.admit(keyHash), fn), false
+}
+
+// TryGet is like Get, but treats the entry as missing instead of waiting, if the bucket
+// is locked by others, e.g. a long Dump. contended is true then. See Stats.Contended.
+func (c *Cache) TryGet(key []byte) (val []byte, ok, contended bool) {
+	ok, contended = c.TryAdvGet(key, func(_val []byte) {
+		val = append(val, _val...)
+	}, false)
+	return
+}
+
+// TryAdvGet is like AdvGet, but fails fast like TryGet.
+func (c *Cache) TryAdvGet(key []byte, fn func(val []byte), peek bool) (ok, contended bool) {
+	keyHash := c.hash(key)
+	return c.buckets[keyHash%BucketCount].TryGet(key, keyHash, fn, peek)
+}
+
+// TrySet is like Set, but gives up instead of waiting, if the bucket is locked by others.
+// contended is true then. See TryGet.
+//
+// It's safe to modify contents of key and val after TrySet returns.
+func (c *Cache) TrySet(key, val []byte) (ok, contended bool) {
+	keyHash := c.hash(key)
+	return c.buckets[keyHash%BucketCount].TrySet(key, keyHash, len(val), func(_val []byte) {
+		copy(_val, val)
+	})
+}
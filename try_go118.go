@@ -0,0 +1,9 @@
+//go:build go1.18
+// +build go1.18
+
+package directcache
+
+import "sync"
+
+// rwMutex is the lock of buckets, which fails fast with TryLock and TryRLock.
+type rwMutex = sync.RWMutex
@@ -0,0 +1,67 @@
+//go:build !go1.18
+// +build !go1.18
+
+package directcache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// rwMutex is the lock of buckets, which fails fast with TryLock and TryRLock.
+// sync.RWMutex has no TryLock before Go 1.18, so holders of the lock, including
+// those waiting for it, are counted to tell whether it's available.
+type rwMutex struct {
+	sync.RWMutex
+	readers, writers int32 // accessed atomically
+}
+
+func (l *rwMutex) Lock() {
+	atomic.AddInt32(&l.writers, 1)
+	l.RWMutex.Lock()
+}
+
+func (l *rwMutex) Unlock() {
+	l.RWMutex.Unlock()
+	atomic.AddInt32(&l.writers, -1)
+}
+
+func (l *rwMutex) RLock() {
+	atomic.AddInt32(&l.readers, 1)
+	l.RWMutex.RLock()
+}
+
+func (l *rwMutex) RUnlock() {
+	l.RWMutex.RUnlock()
+	atomic.AddInt32(&l.readers, -1)
+}
+
+// TryLock locks l if no one else holds or waits for it.
+// It may still wait shortly for others who come at the same time.
+func (l *rwMutex) TryLock() bool {
+	if !atomic.CompareAndSwapInt32(&l.writers, 0, 1) {
+		return false
+	}
+	// count itself first, so that either it or a concurrent TryRLock sees the other
+	if atomic.LoadInt32(&l.readers) != 0 {
+		atomic.AddInt32(&l.writers, -1)
+		return false
+	}
+	l.RWMutex.Lock()
+	return true
+}
+
+// TryRLock read-locks l if no writer holds or waits for it.
+// It may still wait shortly for writers who come at the same time.
+func (l *rwMutex) TryRLock() bool {
+	if atomic.LoadInt32(&l.writers) != 0 {
+		return false
+	}
+	atomic.AddInt32(&l.readers, 1)
+	if atomic.LoadInt32(&l.writers) != 0 {
+		atomic.AddInt32(&l.readers, -1)
+		return false
+	}
+	l.RWMutex.RLock()
+	return true
+}
@@ -0,0 +1,41 @@
+package directcache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheTry(t *testing.T) {
+	c := New(0)
+	k := []byte("k")
+	ok, contended := c.TrySet(k, []byte("v"))
+	require.True(t, ok)
+	require.False(t, contended)
+	val, ok, contended := c.TryGet(k)
+	require.True(t, ok)
+	require.False(t, contended)
+	require.Equal(t, []byte("v"), val)
+
+	// blocked by a slow reader
+	c.AdvGet(k, func([]byte) {
+		_, ok, contended = c.TryGet(k)
+		require.True(t, ok, "readers never block each other")
+		require.False(t, contended)
+
+		ok, contended = c.TrySet(k, []byte("v2"))
+		require.False(t, ok)
+		require.True(t, contended)
+	}, false)
+
+	// blocked by a writer
+	c.AdvSet(k, 1, func([]byte) {
+		_, ok, contended = c.TryGet(k)
+		require.False(t, ok)
+		require.True(t, contended)
+		ok, contended = c.TryAdvGet(k, func([]byte) { panic("should not be called") }, true)
+		require.False(t, ok)
+		require.True(t, contended)
+	})
+	require.Equal(t, 3, c.Stats().Contended)
+}
@@ -0,0 +1,218 @@
+package directcache
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrTxnUnfit is returned by Txn if writes of the transaction can't fit in buckets.
+var ErrTxnUnfit = errors.New("directcache: transaction writes can't fit in buckets")
+
+// txWrite is a staged write of the transaction.
+type txWrite struct {
+	key     []byte
+	keyHash uint64
+	val     []byte
+	del     bool
+}
+
+// Tx presents a transaction over declared keys. Writes are staged and applied
+// after the transaction function returns nil.
+type Tx struct {
+	c      *Cache
+	keys   map[string]uint64 // declared keys to hashes
+	writes map[string]*txWrite
+	order  []*txWrite
+}
+
+// Get returns the value of the entry matching the given key, including staged writes.
+// It returns false if no matched entry. It panics if the key is not declared.
+func (tx *Tx) Get(key []byte) (val []byte, ok bool) {
+	keyHash := tx.hash(key)
+	if w := tx.writes[string(key)]; w != nil {
+		if w.del {
+			return nil, false
+		}
+		return append([]byte(nil), w.val...), true
+	}
+	if ent, found := tx.c.buckets[keyHash%BucketCount].lookup(key, keyHash); found && ent.readable() {
+		return append([]byte(nil), ent.Value()...), true
+	}
+	return nil, false
+}
+
+// Set stages the (key, val) entry. It panics if the key is not declared.
+//
+// It's safe to modify contents of key and val after Set returns.
+func (tx *Tx) Set(key, val []byte) {
+	tx.stage(key, append([]byte(nil), val...), false)
+}
+
+// Del stages the deletion of the key. It panics if the key is not declared.
+func (tx *Tx) Del(key []byte) {
+	tx.stage(key, nil, true)
+}
+
+func (tx *Tx) hash(key []byte) uint64 {
+	keyHash, ok := tx.keys[string(key)]
+	if !ok {
+		panic(errors.New("directcache: key not declared in the transaction"))
+	}
+	return keyHash
+}
+
+func (tx *Tx) stage(key, val []byte, del bool) {
+	keyHash := tx.hash(key)
+	w := tx.writes[string(key)]
+	if w == nil {
+		w = &txWrite{key: append([]byte(nil), key...), keyHash: keyHash}
+		tx.writes[string(key)] = w
+		tx.order = append(tx.order, w)
+	}
+	w.val, w.del = val, del
+}
+
+// Txn runs fn in a transaction over the given keys, whose buckets are locked
+// during the transaction. fn can only access the declared keys through tx.
+//
+// Writes are applied all together only if fn returns nil. They are validated before
+// applied, and ErrTxnUnfit is returned if they can't fit in buckets, or overwriting pinned
+// entries would exceed the pin limit. Entries written by the transaction never evict each
+// other, and bypass the admission filter.
+func (c *Cache) Txn(keys [][]byte, fn func(tx *Tx) error) error {
+	tx := &Tx{
+		c:      c,
+		keys:   make(map[string]uint64, len(keys)),
+		writes: make(map[string]*txWrite, len(keys)),
+	}
+	var bktIndices []int
+	for _, key := range keys {
+		keyHash := c.hash(key)
+		tx.keys[string(key)] = keyHash
+		bktIndices = append(bktIndices, int(keyHash%BucketCount))
+	}
+	// lock in ascending order to avoid deadlock
+	sort.Ints(bktIndices)
+	locked := bktIndices[:0]
+	for _, i := range bktIndices {
+		if len(locked) == 0 || locked[len(locked)-1] != i {
+			locked = append(locked, i)
+			c.buckets[i].lock.Lock()
+		}
+	}
+	defer func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			c.buckets[locked[i]].lock.Unlock()
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	// group writes by bucket
+	var groups [BucketCount][]*txWrite
+	for _, w := range tx.order {
+		i := w.keyHash % BucketCount
+		groups[i] = append(groups[i], w)
+	}
+	for _, i := range locked {
+		c.buckets[i].sortTxn(groups[i])
+		if !c.buckets[i].fitTxn(groups[i]) {
+			return ErrTxnUnfit
+		}
+	}
+	for _, i := range locked {
+		c.buckets[i].applyTxn(groups[i])
+	}
+	return nil
+}
+
+// txnRank ranks the write in the order to apply. Deletes go first to free space, and then
+// overwrites of pinned entries, which are re-pinned before any temporary pin.
+func (b *bucket) txnRank(w *txWrite) int {
+	if w.del {
+		return 0
+	}
+	if old, found := b.lookup(w.key, w.keyHash); found && old.HasFlag(pinnedFlag) && !inPlace(old, w) {
+		return 1
+	}
+	return 2
+}
+
+// sortTxn sorts writes in the order to apply.
+func (b *bucket) sortTxn(writes []*txWrite) {
+	sort.SliceStable(writes, func(i, j int) bool { return b.txnRank(writes[i]) < b.txnRank(writes[j]) })
+}
+
+// inPlace returns true if the write updates the old entry in place, see bucket.set.
+func inPlace(old entry, w *txWrite) bool {
+	return old.BodySize() >= len(w.key)+len(w.val) && old.extFlags() == 0
+}
+
+// fitTxn checks whether sorted writes can be applied without failure.
+func (b *bucket) fitTxn(writes []*txWrite) bool {
+	size, pinned := 0, b.pinned
+	for i, w := range writes {
+		// keys of the same hash displace each other. vmap may only use the high 32 bits.
+		for _, other := range writes[:i] {
+			if other.keyHash>>32 == w.keyHash>>32 {
+				return false
+			}
+		}
+		old, found := b.lookup(w.key, w.keyHash)
+		n := entrySize(len(w.key), len(w.val), 0)
+		if !w.del && !b.ns.Fits(w.key, n) {
+			return false
+		}
+		switch {
+		case !found:
+			size += n
+		case w.del:
+			if old.HasFlag(pinnedFlag) {
+				pinned -= old.Size()
+			}
+		case inPlace(old, w):
+			// pinned temporarily if not pinned
+			if !old.HasFlag(pinnedFlag) {
+				size += old.Size()
+			}
+		case old.HasFlag(pinnedFlag):
+			// re-pinned, see bucket.set
+			if pinned = pinned - old.Size() + n; pinned > b.maxPinned() || pinned > b.q.Cap() {
+				return false
+			}
+		default:
+			size += n
+		}
+	}
+	return size <= b.q.Cap()-pinned
+}
+
+// applyTxn applies sorted writes. New entries are pinned until all writes done, so that
+// they never evict each other. The temporary pins may exceed the pin limit.
+func (b *bucket) applyTxn(writes []*txWrite) {
+	var temp []*txWrite
+	for _, w := range writes {
+		if w.del {
+			if ent, found := b.lookup(w.key, w.keyHash); found {
+				b.del(ent, w.keyHash)
+			}
+			continue
+		}
+		val := w.val
+		if !b.set([][]byte{w.key}, w.keyHash, len(val), nil, -1, func(v []byte) { copy(v, val) }) {
+			// will never go here if fitTxn is correctly implemented
+			panic(errors.New("bucket.applyTxn: set entry failed"))
+		}
+		if ent, _ := b.lookup(w.key, w.keyHash); !ent.HasFlag(pinnedFlag) {
+			b.pin(ent)
+			temp = append(temp, w)
+		}
+	}
+	for _, w := range temp {
+		ent, _ := b.lookup(w.key, w.keyHash)
+		ent.RemoveFlag(pinnedFlag)
+		b.pinned -= ent.Size()
+	}
+}
@@ -0,0 +1,168 @@
+package directcache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheTxn(t *testing.T) {
+	c := New(0)
+	k1, k2, k3 := []byte("k1"), []byte("k2"), []byte("k3")
+	c.Set(k3, []byte("v3"))
+
+	require.NoError(t, c.Txn([][]byte{k1, k2, k3}, func(tx *Tx) error {
+		_, ok := tx.Get(k1)
+		require.False(t, ok)
+		tx.Set(k1, []byte("v1"))
+		val, ok := tx.Get(k1)
+		require.True(t, ok)
+		require.Equal(t, []byte("v1"), val)
+
+		val, _ = tx.Get(k3)
+		tx.Set(k2, val)
+		tx.Del(k3)
+		_, ok = tx.Get(k3)
+		require.False(t, ok)
+
+		// not applied yet
+		_, found := c.buckets[xxhash.Sum64(k1)%BucketCount].lookup(k1, xxhash.Sum64(k1))
+		require.False(t, found)
+		return nil
+	}))
+	val, _ := c.Get(k1)
+	require.Equal(t, []byte("v1"), val)
+	val, _ = c.Get(k2)
+	require.Equal(t, []byte("v3"), val)
+	require.False(t, c.Has(k3))
+
+	// aborted
+	errAbort := errors.New("abort")
+	require.Equal(t, errAbort, c.Txn([][]byte{k1, k2}, func(tx *Tx) error {
+		tx.Del(k1)
+		tx.Set(k2, []byte("v"))
+		return errAbort
+	}))
+	require.True(t, c.Has(k1))
+	val, _ = c.Get(k2)
+	require.Equal(t, []byte("v3"), val)
+
+	require.Panics(t, func() {
+		c.Txn([][]byte{k1}, func(tx *Tx) error {
+			tx.Set(k2, nil)
+			return nil
+		})
+	})
+	// buckets unlocked after panic
+	require.True(t, c.Has(k2))
+}
+
+func TestCacheTxnFit(t *testing.T) {
+	val := make([]byte, 60)
+	size := entrySize(4, len(val), 0)
+	c := New(size * 4 * BucketCount)
+
+	// keys in the same bucket
+	var keys [][]byte
+	for i := 0; len(keys) < 6; i++ {
+		if k := []byte(fmt.Sprintf("%04d", i)); xxhash.Sum64(k)%BucketCount == 0 {
+			keys = append(keys, k)
+		}
+	}
+
+	require.Equal(t, ErrTxnUnfit, c.Txn(keys[:5], func(tx *Tx) error {
+		for _, k := range keys[:5] {
+			tx.Set(k, val)
+		}
+		return nil
+	}))
+	require.Zero(t, c.Len())
+
+	// other entries are recently used and pushed back, but entries written never evict each other
+	for _, k := range keys[4:] {
+		c.Set(k, val)
+		c.Has(k)
+	}
+	require.NoError(t, c.Txn(keys[:4], func(tx *Tx) error {
+		for _, k := range keys[:4] {
+			tx.Set(k, val)
+		}
+		return nil
+	}))
+	for _, k := range keys[:4] {
+		require.True(t, c.Has(k))
+	}
+	require.Zero(t, c.Stats().PinnedBytes)
+}
+
+func TestCacheTxnPinned(t *testing.T) {
+	val := make([]byte, 60)
+	size := entrySize(4, len(val), 0)
+	c := New(size * 4 * BucketCount)
+
+	// keys in the same bucket
+	var keys [][]byte
+	for i := 0; len(keys) < 4; i++ {
+		if k := []byte(fmt.Sprintf("%04d", i)); xxhash.Sum64(k)%BucketCount == 0 {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys[:2] {
+		require.True(t, c.Set(k, val))
+		require.True(t, c.Pin(k))
+	}
+	require.Equal(t, size*2, c.Stats().PinnedBytes)
+
+	// re-pinning exceeds the limit, which is half of the bucket
+	require.Equal(t, ErrTxnUnfit, c.Txn(keys[:1], func(tx *Tx) error {
+		tx.Set(keys[0], make([]byte, len(val)+1))
+		return nil
+	}))
+	got, _ := c.Get(keys[0])
+	require.Equal(t, val, got)
+
+	// deletes free pinned space before other writes
+	require.NoError(t, c.Txn(keys, func(tx *Tx) error {
+		tx.Set(keys[2], val)
+		tx.Set(keys[3], val)
+		tx.Set(keys[0], make([]byte, len(val)+1))
+		tx.Del(keys[1])
+		return nil
+	}))
+	for i, k := range keys {
+		require.Equal(t, i != 1, c.Has(k))
+	}
+	require.Equal(t, entrySize(4, len(val)+1, 0), c.Stats().PinnedBytes)
+}
+
+func TestCacheTxnConcurrent(t *testing.T) {
+	c := New(0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				idx, data := []byte(fmt.Sprint("idx", j%10)), []byte(fmt.Sprint("data", j%10))
+				require.NoError(t, c.Txn([][]byte{data, idx}, func(tx *Tx) error {
+					_, hasIdx := tx.Get(idx)
+					_, hasData := tx.Get(data)
+					require.Equal(t, hasIdx, hasData)
+					if i%2 == 0 {
+						tx.Set(idx, data)
+						tx.Set(data, []byte{byte(i)})
+					} else {
+						tx.Del(idx)
+						tx.Del(data)
+					}
+					return nil
+				}))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,117 @@
+package directcache
+
+import (
+	"bytes"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// partsLen returns the total length of parts.
+func partsLen(parts [][]byte) int {
+	n := 0
+	for _, part := range parts {
+		n += len(part)
+	}
+	return n
+}
+
+// partsEqual reports whether the concatenation of parts equals to b.
+func partsEqual(parts [][]byte, b []byte) bool {
+	for _, part := range parts {
+		if len(part) > len(b) || !bytes.Equal(part, b[:len(part)]) {
+			return false
+		}
+		b = b[len(part):]
+	}
+	return len(b) == 0
+}
+
+// hashKeyV is like hashKey, with the key given in parts.
+func hashKeyV(parts [][]byte, tags bool) uint64 {
+	var d, td xxhash.Digest
+	d.Reset()
+	td.Reset()
+	// 0: before '{', 1: inside the tag, 2: after '}'
+	state, tagLen := 0, 0
+	for _, part := range parts {
+		d.Write(part)
+		if !tags || state == 2 {
+			continue
+		}
+		if state == 0 {
+			i := bytes.IndexByte(part, '{')
+			if i < 0 {
+				continue
+			}
+			part, state = part[i+1:], 1
+		}
+		if j := bytes.IndexByte(part, '}'); j >= 0 {
+			part, state = part[:j], 2
+		}
+		td.Write(part)
+		tagLen += len(part)
+	}
+	h := d.Sum64()
+	if state == 2 && tagLen > 0 {
+		return h&^(BucketCount-1) | td.Sum64()&(BucketCount-1)
+	}
+	return h
+}
+
+// GetV gets the value for the key given in parts.
+func (b *bucket) GetV(keyParts [][]byte, keyHash uint64, fn func(val []byte), peek bool) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if !peek && b.admission != nil {
+		b.admission.Add(keyHash)
+	}
+	if offset, found := b.m.Get(keyHash); found {
+		if ent := b.entryAt(offset); partsEqual(keyParts, ent.Key()) && ent.readable() {
+			if !peek {
+				ent.AddFlag(recentlyUsedFlag)
+				ent.IncFrequency()
+			}
+			if fn != nil {
+				fn(ent.Value())
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// SetV sets val for the key given in parts.
+func (b *bucket) SetV(keyParts [][]byte, keyHash uint64, valLen int, fn func(val []byte)) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.set(keyParts, keyHash, valLen, nil, b.admit(keyHash), fn)
+}
+
+// SetV is like Set, but the key and value are given in parts, which are
+// written into the cache directly without concatenation.
+//
+// It's safe to modify contents of parts after SetV returns.
+func (c *Cache) SetV(keyParts [][]byte, valParts [][]byte) bool {
+	keyHash := c.hashV(keyParts)
+	return c.buckets[keyHash%BucketCount].SetV(keyParts, keyHash, partsLen(valParts), func(val []byte) {
+		for _, part := range valParts {
+			val = val[copy(val, part):]
+		}
+	})
+}
+
+// GetV is like Get, but the key is given in parts.
+//
+// It's safe to modify contents of parts after GetV returns.
+func (c *Cache) GetV(keyParts ...[]byte) (val []byte, ok bool) {
+	keyHash := c.hashV(keyParts)
+	ok = c.buckets[keyHash%BucketCount].GetV(keyParts, keyHash, func(_val []byte) {
+		val = append(val, _val...)
+	}, false)
+	return
+}
+
+// hashV is like hash, with the key given in parts.
+func (c *Cache) hashV(keyParts [][]byte) uint64 {
+	return hashKeyV(keyParts, c.hashTagsEnabled())
+}
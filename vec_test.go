@@ -0,0 +1,60 @@
+package directcache
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// split splits b into random parts.
+func split(b []byte) (parts [][]byte) {
+	for len(b) > 0 {
+		n := rand.Intn(len(b) + 1)
+		parts = append(parts, b[:n])
+		b = b[n:]
+	}
+	return append(parts, nil)
+}
+
+func Test_partsEqual(t *testing.T) {
+	require.True(t, partsEqual(nil, nil))
+	require.True(t, partsEqual([][]byte{[]byte("ab"), nil, []byte("c")}, []byte("abc")))
+	require.False(t, partsEqual([][]byte{[]byte("ab")}, []byte("abc")))
+	require.False(t, partsEqual([][]byte{[]byte("ab"), []byte("cd")}, []byte("abc")))
+	require.False(t, partsEqual([][]byte{[]byte("ab"), []byte("d")}, []byte("abc")))
+}
+
+func Test_hashKeyV(t *testing.T) {
+	keys := []string{"", "plain", "user:{42}:profile", "{}x", "{{a}}", "x}{", "{a}{b}", "x{abc"}
+	for _, k := range keys {
+		for i := 0; i < 20; i++ {
+			parts := split([]byte(k))
+			require.Equal(t, hashKey([]byte(k), false), hashKeyV(parts, false), k)
+			require.Equal(t, hashKey([]byte(k), true), hashKeyV(parts, true), k)
+		}
+	}
+}
+
+func TestCacheSetV(t *testing.T) {
+	c := New(0)
+	key, val := []byte("tenant:type:id"), []byte("header|body")
+	for i := 0; i < 20; i++ {
+		require.True(t, c.SetV(split(key), split(val)))
+		got, ok := c.Get(key)
+		require.True(t, ok)
+		require.Equal(t, val, got)
+
+		got, ok = c.GetV(split(key)...)
+		require.True(t, ok)
+		require.Equal(t, val, got)
+	}
+	_, ok := c.GetV([]byte("tenant:"), []byte("type:id2"))
+	require.False(t, ok)
+
+	// larger value re-inserted
+	require.True(t, c.SetV([][]byte{key}, [][]byte{val, val}))
+	got, _ := c.GetV(key)
+	require.Equal(t, append(val, val...), got)
+	require.Equal(t, 1, c.Len())
+}
@@ -0,0 +1,133 @@
+package directcache
+
+import (
+	"bytes"
+	"sync"
+)
+
+// EventType is the type of the change to a watched key.
+type EventType int
+
+// event types.
+const (
+	EventSet     EventType = iota // the key is inserted
+	EventUpdate                   // the value of the existing key is updated
+	EventDelete                   // the key is deleted explicitly
+	EventEvicted                  // the key is evicted by the cache
+)
+
+// Event presents the change to a watched key.
+type Event struct {
+	Type EventType
+	Key  []byte
+}
+
+// watchChanSize is the buffer size of the watch channel.
+// Events are dropped if the buffer is full.
+const watchChanSize = 16
+
+// watcher receives events of the key.
+type watcher struct {
+	key []byte
+	ch  chan Event
+}
+
+// Watch registers a watcher for the key.
+// nil is returned if the key hash is stale, since hash tags are switched.
+func (b *bucket) Watch(key []byte, keyHash uint64) *watcher {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if hashKey(key, b.hashTags) != keyHash {
+		return nil
+	}
+	w := &watcher{
+		key: append([]byte(nil), key...),
+		ch:  make(chan Event, watchChanSize),
+	}
+	b.watch(w, keyHash)
+	return w
+}
+
+// watch is the lock-free version of Watch, which registers the existing watcher.
+func (b *bucket) watch(w *watcher, keyHash uint64) {
+	if b.watchers == nil {
+		b.watchers = make(map[uint64][]*watcher)
+	}
+	b.watchers[keyHash] = append(b.watchers[keyHash], w)
+}
+
+// Unwatch unregisters the watcher and closes its channel.
+// false is returned if the watcher is not found, e.g. moved to another bucket.
+func (b *bucket) Unwatch(w *watcher, keyHash uint64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ws := b.watchers[keyHash]
+	for i := range ws {
+		if ws[i] == w {
+			if ws = append(ws[:i], ws[i+1:]...); len(ws) > 0 {
+				b.watchers[keyHash] = ws
+			} else {
+				delete(b.watchers, keyHash)
+			}
+			close(w.ch)
+			return true
+		}
+	}
+	return false
+}
+
+// notify sends the event to watchers of the key. It costs nothing if nobody is watching.
+// Events are dropped for slow watchers.
+func (b *bucket) notify(typ EventType, key []byte, keyHash uint64) {
+	if len(b.watchers) == 0 {
+		return
+	}
+	for _, w := range b.watchers[keyHash] {
+		if !bytes.Equal(w.key, key) {
+			continue
+		}
+		select {
+		case w.ch <- Event{typ, w.key}:
+		default:
+			b.dropped++
+		}
+	}
+}
+
+// notifyAll sends the event to watchers of all existing keys.
+func (b *bucket) notifyAll(typ EventType) {
+	for keyHash, ws := range b.watchers {
+		for _, w := range ws {
+			if _, found := b.lookup(w.key, keyHash); found {
+				b.notify(typ, w.key, keyHash)
+				break
+			}
+		}
+	}
+}
+
+// Watch watches changes to the entry matching the given key. Changes are delivered as
+// events through the returned channel, until cancel is called, which also closes the channel.
+//
+// Events are dropped if not received in time, see Stats.DroppedEvents.
+// Key of the event is shared and should never be modified.
+// Watchers are kept when hash tags are switched, see SetHashTags.
+func (c *Cache) Watch(key []byte) (events <-chan Event, cancel func()) {
+	var w *watcher
+	for w == nil {
+		keyHash := c.hash(key)
+		w = c.buckets[keyHash%BucketCount].Watch(key, keyHash)
+	}
+	var once sync.Once
+	return w.ch, func() {
+		once.Do(func() {
+			// retry if the watcher is moved by SetHashTags meanwhile
+			for {
+				keyHash := c.hash(w.key)
+				if c.buckets[keyHash%BucketCount].Unwatch(w, keyHash) {
+					return
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package directcache
+
+import (
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_bucketWatch(t *testing.T) {
+	var bkt bucket
+	bkt.Reset(entrySize(2, 2, 0) * 4)
+
+	set := func(k string, valLen int) bool {
+		return bkt.Set([]byte(k), xxhash.Sum64([]byte(k)), valLen, func(val []byte) {})
+	}
+	k := []byte("k1")
+	kh := xxhash.Sum64(k)
+	w := bkt.Watch(k, kh)
+	next := func() EventType {
+		select {
+		case ev := <-w.ch:
+			require.Equal(t, k, ev.Key)
+			return ev.Type
+		default:
+			return -1
+		}
+	}
+
+	set("k1", 2)
+	require.Equal(t, EventSet, next())
+	set("k1", 1)
+	require.Equal(t, EventUpdate, next())
+	set("k1", 10)
+	require.Equal(t, EventUpdate, next())
+	set("k2", 2)
+	require.Equal(t, EventType(-1), next(), "other key")
+	bkt.Del(k, kh)
+	require.Equal(t, EventDelete, next())
+
+	set("k1", 2)
+	require.Equal(t, EventSet, next())
+	for i := 0; i < 5; i++ {
+		set(string([]byte{'x', byte(i)}), 2)
+	}
+	require.Equal(t, EventEvicted, next())
+
+	set("k1", 2)
+	bkt.Reset(1000)
+	require.Equal(t, EventSet, next())
+	require.Equal(t, EventDelete, next())
+
+	// slow watcher
+	for i := 0; i < watchChanSize+3; i++ {
+		set("k1", 2)
+	}
+	require.Equal(t, 3, bkt.Stats().DroppedEvents)
+
+	bkt.Unwatch(w, kh)
+	require.Empty(t, bkt.watchers)
+	for range w.ch {
+	}
+	set("k1", 3)
+}